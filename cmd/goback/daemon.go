@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/devplayg/yuna/goback"
+)
+
+func daemon(args []string) {
+	fs = flag.NewFlagSet("daemon", flag.ExitOnError)
+
+	var (
+		configFile = fs.String("c", "", "Job configuration file (YAML)")
+		debug      = fs.Bool("debug", false, "Debug")
+	)
+	fs.Usage = printDaemonHelp
+	fs.Parse(args)
+
+	if *configFile == "" {
+		printDaemonHelp()
+		return
+	}
+
+	config, err := goback.LoadConfig(*configFile)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	d, err := goback.NewDaemon(config, *debug)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("received %s; stopping", sig)
+		close(stop)
+	}()
+
+	d.Run(stop)
+}
+
+func printDaemonHelp() {
+	fmt.Println("backup daemon - Run jobs of a configuration file on their schedules")
+	fmt.Println("backup daemon -c [file]")
+	fmt.Println("ex) backup daemon -c /etc/goback/jobs.yaml")
+	fs.PrintDefaults()
+}
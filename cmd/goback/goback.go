@@ -1,13 +1,18 @@
 package main
 
 import (
+	"encoding/csv"
 	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/devplayg/yuna/goback"
+	"github.com/dustin/go-humanize"
 )
 
 const (
@@ -15,6 +20,12 @@ const (
 	Version     = "1.0.1804.12901"
 )
 
+// Exit codes of backups
+const (
+	exitFailed  = 1 // The backup failed
+	exitPartial = 2 // Some files failed; the others were backed up
+)
+
 var (
 	fs *flag.FlagSet
 )
@@ -31,14 +42,61 @@ func main() {
 	// Set CPU count
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			restore(os.Args[2:])
+			return
+		case "restore-path":
+			restorePath(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		case "prune":
+			prune(os.Args[2:])
+			return
+		case "run":
+			run(os.Args[2:])
+			return
+		case "daemon":
+			daemon(os.Args[2:])
+			return
+		case "resume":
+			resume(os.Args[2:])
+			return
+		}
+	}
+
 	fs = flag.NewFlagSet("", flag.ExitOnError)
 
 	var (
-		srcDir  = fs.String("s", "", "Source directory")
-		dstDir  = fs.String("d", "", "Destination directory")
-		version = fs.Bool("v", false, "Version")
-		debug   = fs.Bool("debug", false, "Debug")
+		srcDirs  stringList
+		dstDir   = fs.String("d", "", "Destination directory")
+		job      = fs.String("job", "", "Job name; each job keeps its own baseline")
+		dedup    = fs.Bool("dedup", false, "Store files as deduplicated chunks")
+		checksum = fs.Bool("checksum", false, "Detect changes by content checksum")
+		workers  = fs.Int("workers", runtime.NumCPU(), "Number of files copied at the same time")
+		batch    = fs.Int("batch-size", goback.DefaultBatchSize, "Rows written to the databases per insert statement")
+		excludes stringList
+		exclFile = fs.String("exclude-from", "", "File of exclude patterns")
+		wait     = fs.Bool("wait", false, "Wait for another backup of the destination to finish")
+		compress = fs.String("compress", "", "Compress copies with gzip or zstd")
+		level    = fs.Int("compress-level", 0, "Compression level; 0 is the default of the codec")
+		archive  = fs.String("archive", "", "Write the changed files of a run into one tar.zst or zip archive")
+		snapshot = fs.Bool("snapshot", false, "Make every dated directory a complete tree; unchanged files are hard links")
+		storage  = fs.String("storage", "", "Store copies in s3://bucket/prefix or sftp://user@host/path instead of the destination directory")
+		dryRun   = fs.Bool("dry-run", false, "Report what would be backed up without storing anything")
+		dryOut   = fs.String("dry-run-out", "", "Also write the dry run report to a CSV file")
+		skipExts stringList
+		passFile = fs.String("passphrase-file", "", "File of the passphrase encrypting copies, not catalogs; GOBACK_PASSPHRASE if not set. Not with -dedup, -archive or -snapshot")
+		version  = fs.Bool("v", false, "Version")
+		debug    = fs.Bool("debug", false, "Debug")
 	)
+	fs.Var(&srcDirs, "s", "Source directory (repeatable)")
+	fs.Var(&excludes, "x", "Exclude pattern (gitignore style, repeatable)")
+	fs.Var(&skipExts, "skip-compress", "Extension stored uncompressed, e.g. .iso (repeatable)")
 	fs.Usage = printHelp
 	fs.Parse(os.Args[1:])
 
@@ -48,52 +106,159 @@ func main() {
 	}
 
 	// Check directory parameters
-	if *srcDir == "" || *dstDir == "" {
+	if len(srcDirs) < 1 || *dstDir == "" {
 		printHelp()
 		return
 	}
 
-	// Check source directory
-	fi, err := os.Lstat(*srcDir)
-	if err != nil {
-		log.Error(err)
-		return
-	}
-	if !fi.Mode().IsDir() {
-		log.Errorf("invalid source directory: %s", fi.Name())
-		return
+	// Check source directories
+	for _, srcDir := range srcDirs {
+		fi, err := os.Lstat(srcDir)
+		if err != nil {
+			log.Error(err)
+			os.Exit(exitFailed)
+		}
+		if !fi.Mode().IsDir() {
+			log.Errorf("invalid source directory: %s", fi.Name())
+			os.Exit(exitFailed)
+		}
 	}
 
 	// Check destination directory
-	fi, err = os.Lstat(*srcDir)
+	fi, err := os.Lstat(*dstDir)
 	if err != nil {
 		log.Error(err)
-		return
+		os.Exit(exitFailed)
 	}
 	if !fi.Mode().IsDir() {
 		log.Errorf("invalid destination directory: %s", fi.Name())
-		return
+		os.Exit(exitFailed)
 	}
 
 	//	Start backup files
-	b := goback.NewBackup(*srcDir, *dstDir, *debug)
-	defer b.Close()
-
-	// Initialize backup
-	if err := b.Initialize(); err != nil {
+	j := goback.NewJob(*job, srcDirs, *dstDir, *debug)
+	j.Options.Dedup = *dedup
+	j.Options.Checksum = *checksum
+	j.Options.Workers = *workers
+	j.Options.BatchSize = *batch
+	j.Options.WaitLock = *wait
+	j.Options.Compression = *compress
+	j.Options.CompressionLevel = *level
+	j.Options.SkipCompress = skipExts
+	j.Options.Archive = *archive
+	j.Options.Snapshot = *snapshot
+	j.Options.StorageURL = *storage
+	j.Options.DryRun = *dryRun || *dryOut != ""
+	passphrase, err := goback.ReadPassphrase(*passFile)
+	if err != nil {
 		log.Error(err)
-		return
+		os.Exit(exitFailed)
+	}
+	j.Options.Passphrase = passphrase
+	if *exclFile != "" {
+		patterns, err := goback.ReadPatterns(*exclFile)
+		if err != nil {
+			log.Error(err)
+			os.Exit(exitFailed)
+		}
+		j.Options.Excludes = append(j.Options.Excludes, patterns...)
 	}
+	j.Options.Excludes = append(j.Options.Excludes, excludes...)
 
-	// Start backup
-	if err = b.Start(); err != nil {
+	err = j.Run()
+	if j.Options.DryRun {
+		printChanges(j.Summaries)
+		if *dryOut != "" {
+			if err := writeChanges(*dryOut, j.Summaries); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	if err != nil {
 		log.Error(err)
+		os.Exit(exitCode(err))
 	}
 }
 
+// exitCode returns the exit code of a failed backup
+func exitCode(err error) int {
+	if goback.IsPartial(err) {
+		return exitPartial
+	}
+	return exitFailed
+}
+
+func printChanges(summaries []*goback.Summary) {
+	for _, s := range summaries {
+		fmt.Printf("%s: %d added, %d modified, %d deleted, %d moved; projected backup size %d(%s)\n",
+			s.SrcDir, s.BackupAdded, s.BackupModified, s.BackupDeleted, s.BackupMoved, s.BackupSize, humanize.Bytes(s.BackupSize))
+		if len(s.Changes) < 1 {
+			continue
+		}
+		fmt.Printf("%-5s %12s %-25s %s\n", "STATE", "SIZE", "MTIME", "PATH")
+		for _, f := range s.Changes {
+			fmt.Printf("%-5s %12d %-25s %s\n", goback.StateName(f.State), f.Size, f.ModTime.Format(time.RFC3339), movedPath(f.OldPath, f.Path))
+		}
+	}
+}
+
+// writeChanges writes the files of dry runs as CSV
+func writeChanges(name string, summaries []*goback.Summary) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"src_dir", "state", "size", "mtime", "path", "old_path"})
+	for _, s := range summaries {
+		for _, c := range s.Changes {
+			w.Write([]string{
+				s.SrcDir,
+				goback.StateName(c.State),
+				strconv.FormatInt(c.Size, 10),
+				c.ModTime.Format(time.RFC3339),
+				c.Path,
+				c.OldPath,
+			})
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// stringList is a repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func printHelp() {
 	fmt.Println("backup - Backup changed files")
 	fmt.Println("backup [options]")
 	fmt.Println("ex) backup -s /home/data -d /backup")
+	fmt.Println("ex) backup -s /home/data -s /etc -d /backup")
+	fmt.Println("ex) backup -s /home/data -d /backup -dry-run")
+	fmt.Println("")
+	fmt.Println("commands:")
+	fmt.Println("  restore         Restore the source tree as of a backup")
+	fmt.Println("  restore-path    Restore a file or a subtree as of a point in time")
+	fmt.Println("  verify          Verify stored copies against the catalog")
+	fmt.Println("  prune           Delete backups expired by the retention policy")
+	fmt.Println("  run             Run jobs of a configuration file")
+	fmt.Println("  daemon          Run jobs of a configuration file on their schedules")
+	fmt.Println("  resume          Finish or roll back backups interrupted by a crash")
+	fmt.Println("")
+	fmt.Println("exit codes: 0 backed up, 1 failed, 2 some files failed")
 	fs.PrintDefaults()
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+
+	"github.com/devplayg/yuna/goback"
+)
+
+func prune(args []string) {
+	fs = flag.NewFlagSet("prune", flag.ExitOnError)
+
+	var (
+		dstDir = fs.String("d", "", "Backup directory")
+		last   = fs.Int("keep-last", 0, "Keep the last n backups")
+		daily  = fs.Int("keep-daily", 0, "Keep the last backup of the last n days")
+		weekly = fs.Int("keep-weekly", 0, "Keep the last backup of the last n weeks")
+		month  = fs.Int("keep-monthly", 0, "Keep the last backup of the last n months")
+		yearly = fs.Int("keep-yearly", 0, "Keep the last backup of the last n years")
+		dryRun = fs.Bool("dry-run", false, "Show what would be pruned")
+		wait   = fs.Bool("wait", false, "Wait for a backup of the destination to finish")
+		debug  = fs.Bool("debug", false, "Debug")
+		jobs   stringList
+	)
+	fs.Var(&jobs, "job", "Prune only backups of this job (repeatable)")
+	fs.Usage = printPruneHelp
+	fs.Parse(args)
+
+	if *dstDir == "" {
+		printPruneHelp()
+		return
+	}
+
+	policy := goback.RetentionPolicy{
+		Last:    *last,
+		Daily:   *daily,
+		Weekly:  *weekly,
+		Monthly: *month,
+		Yearly:  *yearly,
+	}
+	p := goback.NewPrune(*dstDir, policy, *debug)
+	p.DryRun = *dryRun
+	p.Jobs = jobs
+	p.WaitLock = *wait
+	if err := p.Initialize(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	err := p.Prune()
+	if err != nil {
+		log.Error(err)
+	}
+	p.Close()
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func printPruneHelp() {
+	fmt.Println("backup prune - Delete backups expired by the retention policy")
+	fmt.Println("backup prune [options]")
+	fmt.Println("ex) backup prune -d /backup -keep-daily 60 -keep-monthly 12")
+	fs.PrintDefaults()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+
+	"github.com/devplayg/yuna/goback"
+)
+
+func restore(args []string) {
+	fs = flag.NewFlagSet("restore", flag.ExitOnError)
+
+	var (
+		dstDir    = fs.String("d", "", "Backup directory")
+		backupID  = fs.Int64("id", 0, "Backup ID")
+		targetDir = fs.String("t", "", "Target directory")
+		passFile  = fs.String("passphrase-file", "", "File of the encryption passphrase; GOBACK_PASSPHRASE if not set")
+		debug     = fs.Bool("debug", false, "Debug")
+	)
+	fs.Usage = printRestoreHelp
+	fs.Parse(args)
+
+	if *dstDir == "" || *backupID < 1 || *targetDir == "" {
+		printRestoreHelp()
+		return
+	}
+
+	// Check target directory
+	if err := os.MkdirAll(*targetDir, 0755); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	passphrase, err := goback.ReadPassphrase(*passFile)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	r := goback.NewRestore(*dstDir, *debug)
+	r.Passphrase = passphrase
+	if err := r.Initialize(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	err = r.Restore(*backupID, *targetDir)
+	if err != nil {
+		log.Error(err)
+	}
+	r.Close()
+
+	if err != nil || r.Failed > 0 || r.Missing > 0 {
+		os.Exit(1)
+	}
+}
+
+func printRestoreHelp() {
+	fmt.Println("backup restore - Restore the source tree as of a backup")
+	fmt.Println("backup restore [options]")
+	fmt.Println("ex) backup restore -d /backup -id 12 -t /restore")
+	fs.PrintDefaults()
+}
+
+func restorePath(args []string) {
+	fs = flag.NewFlagSet("restore-path", flag.ExitOnError)
+
+	var (
+		dstDir    = fs.String("d", "", "Backup directory")
+		path      = fs.String("p", "", "File or directory path in the source")
+		at        = fs.String("at", "", "Point in time (YYYY-MM-DD, YYYY-MM-DD hh:mm:ss or RFC3339); default now")
+		backupID  = fs.Int64("id", 0, "Use the version from this backup or older")
+		job       = fs.String("job", "", "Job of the source; needed if several jobs back up the path")
+		srcDir    = fs.String("s", "", "Source directory; needed if nested sources hold the path")
+		targetDir = fs.String("t", "", "Target directory")
+		list      = fs.Bool("l", false, "List versions only")
+		passFile  = fs.String("passphrase-file", "", "File of the encryption passphrase; GOBACK_PASSPHRASE if not set")
+		debug     = fs.Bool("debug", false, "Debug")
+	)
+	fs.Usage = printRestorePathHelp
+	fs.Parse(args)
+
+	if *dstDir == "" || *path == "" || (*targetDir == "" && !*list) {
+		printRestorePathHelp()
+		return
+	}
+
+	t, err := parseTime(*at)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	// Check target directory
+	if !*list {
+		if err := os.MkdirAll(*targetDir, 0755); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+
+	passphrase, err := goback.ReadPassphrase(*passFile)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	r := goback.NewRestore(*dstDir, *debug)
+	r.Passphrase = passphrase
+	r.Job = *job
+	r.SrcDir = *srcDir
+	if err := r.Initialize(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	err = func() error {
+		defer r.Close()
+		if *list {
+			versions, err := r.Versions(*path, t, *backupID)
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			printVersions(versions)
+			return nil
+		}
+		err := r.RestorePath(*path, t, *backupID, *targetDir)
+		if err != nil {
+			log.Error(err)
+		}
+		return err
+	}()
+	if err != nil || r.Failed > 0 || r.Missing > 0 {
+		os.Exit(1)
+	}
+}
+
+func printVersions(versions []*goback.Version) {
+	fmt.Printf("%-6s %-25s %-7s %12s %-25s %s\n", "ID", "BACKUP DATE", "STATE", "SIZE", "MTIME", "PATH")
+	for _, v := range versions {
+		fmt.Printf("%-6d %-25s %-7s %12d %-25s %s\n",
+			v.ID,
+			v.Date.Format(time.RFC3339),
+			goback.StateName(v.State),
+			v.Size,
+			v.ModTime.Format(time.RFC3339),
+			movedPath(v.OldPath, v.Path),
+		)
+	}
+}
+
+// movedPath shows the old path of a moved file with its new path
+func movedPath(oldPath, path string) string {
+	if oldPath == "" {
+		return path
+	}
+	return oldPath + " -> " + path
+}
+
+// parseTime parses a point in time in local time. A date without time means the end of that day.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Now(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04:05", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid time: %s", s)
+	}
+	return t.AddDate(0, 0, 1).Add(-time.Second), nil
+}
+
+func printRestorePathHelp() {
+	fmt.Println("backup restore-path - Restore a file or a subtree as of a point in time")
+	fmt.Println("backup restore-path [options]")
+	fmt.Println("ex) backup restore-path -d /backup -p /data/reports -at 2026-09-01 -l")
+	fmt.Println("ex) backup restore-path -d /backup -p /data/reports/q3.xlsx -at 2026-09-01 -t /restore")
+	fmt.Println("ex) backup restore-path -d /backup -p /data/reports -job daily -s /data -l")
+	fs.PrintDefaults()
+}
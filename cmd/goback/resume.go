@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"runtime"
+
+	"github.com/devplayg/yuna/goback"
+)
+
+func resume(args []string) {
+	fs = flag.NewFlagSet("resume", flag.ExitOnError)
+
+	var (
+		dstDir   = fs.String("d", "", "Backup directory")
+		rollback = fs.Bool("rollback", false, "Delete interrupted backups instead of finishing them")
+		workers  = fs.Int("workers", runtime.NumCPU(), "Number of files copied at the same time")
+		wait     = fs.Bool("wait", false, "Wait for another backup of the destination to finish")
+		passFile = fs.String("passphrase-file", "", "File of the encryption passphrase; GOBACK_PASSPHRASE if not set")
+		debug    = fs.Bool("debug", false, "Debug")
+		jobs     stringList
+	)
+	fs.Var(&jobs, "job", "Resume only backups of this job (repeatable)")
+	fs.Usage = printResumeHelp
+	fs.Parse(args)
+
+	if *dstDir == "" {
+		printResumeHelp()
+		return
+	}
+
+	passphrase, err := goback.ReadPassphrase(*passFile)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	r := goback.NewResume(*dstDir, *debug)
+	r.Passphrase = passphrase
+	r.Jobs = jobs
+	r.Rollback = *rollback
+	r.Workers = *workers
+	r.WaitLock = *wait
+	if err := r.Run(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+}
+
+func printResumeHelp() {
+	fmt.Println("backup resume - Finish or roll back backups interrupted by a crash")
+	fmt.Println("backup resume [options]")
+	fmt.Println("ex) backup resume -d /backup")
+	fmt.Println("ex) backup resume -d /backup -rollback")
+	fs.PrintDefaults()
+}
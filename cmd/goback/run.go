@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+
+	"github.com/devplayg/yuna/goback"
+)
+
+func run(args []string) {
+	fs = flag.NewFlagSet("run", flag.ExitOnError)
+
+	var (
+		configFile = fs.String("c", "", "Job configuration file (YAML)")
+		wait       = fs.Bool("wait", false, "Wait for other backups of the destinations to finish")
+		debug      = fs.Bool("debug", false, "Debug")
+	)
+	fs.Usage = printRunHelp
+	fs.Parse(args)
+
+	if *configFile == "" {
+		printRunHelp()
+		return
+	}
+
+	// Validate the whole file before running anything
+	config, err := goback.LoadConfig(*configFile)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	jobs, err := config.Select(fs.Args())
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	var failed, partial int
+	for _, jc := range jobs {
+		if *wait {
+			jc.WaitLock = true
+		}
+		err := jc.Run(*debug)
+		if goback.IsPartial(err) {
+			log.Warnf("job %s completed with failures: %s", jc.Name, err.Error())
+			partial++
+			continue
+		}
+		if err != nil {
+			log.Errorf("job %s failed: %s", jc.Name, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Errorf("%d of %d jobs failed", failed, len(jobs))
+		os.Exit(exitFailed)
+	}
+	if partial > 0 {
+		log.Warnf("%d of %d jobs completed with failures", partial, len(jobs))
+		os.Exit(exitPartial)
+	}
+}
+
+func printRunHelp() {
+	fmt.Println("backup run - Run jobs of a configuration file in sequence")
+	fmt.Println("backup run -c [file] [job...]")
+	fmt.Println("ex) backup run -c /etc/goback/jobs.yaml")
+	fmt.Println("ex) backup run -c /etc/goback/jobs.yaml home etc")
+	fs.PrintDefaults()
+}
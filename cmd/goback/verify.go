@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+
+	"github.com/devplayg/yuna/goback"
+)
+
+func verify(args []string) {
+	fs = flag.NewFlagSet("verify", flag.ExitOnError)
+
+	var (
+		dstDir   = fs.String("d", "", "Backup directory")
+		backupID = fs.Int64("id", 0, "Backup ID; all backups if not set")
+		passFile = fs.String("passphrase-file", "", "File of the encryption passphrase; GOBACK_PASSPHRASE if not set")
+		debug    = fs.Bool("debug", false, "Debug")
+	)
+	fs.Usage = printVerifyHelp
+	fs.Parse(args)
+
+	if *dstDir == "" {
+		printVerifyHelp()
+		return
+	}
+
+	passphrase, err := goback.ReadPassphrase(*passFile)
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	v := goback.NewVerify(*dstDir, *debug)
+	v.Passphrase = passphrase
+	if err := v.Initialize(); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	err = v.Verify(*backupID)
+	if err != nil {
+		log.Error(err)
+	}
+	v.Close()
+
+	if err != nil || v.Failed() {
+		os.Exit(1)
+	}
+}
+
+func printVerifyHelp() {
+	fmt.Println("backup verify - Verify stored copies against the catalog")
+	fmt.Println("backup verify [options]")
+	fmt.Println("ex) backup verify -d /backup -id 12")
+	fs.PrintDefaults()
+}
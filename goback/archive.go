@@ -0,0 +1,395 @@
+package goback
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Archive storage modes. The changed files of a run are written into a single
+// archive, dstDir/YYYYMMDD.tar.zst or dstDir/YYYYMMDD.zip, instead of a directory tree.
+const (
+	StorageTarZst = "tar.zst"
+	StorageZip    = "zip"
+)
+
+// checkArchive checks an archive format and the compression level of tar.zst
+func checkArchive(format string, level int) error {
+	switch format {
+	case "", StorageZip:
+		return nil
+	case StorageTarZst:
+		return checkCodec(CodecZstd, level)
+	}
+	return fmt.Errorf("unknown archive format: %s", format)
+}
+
+func isArchive(storage string) bool {
+	return storage == StorageTarZst || storage == StorageZip
+}
+
+// memberName returns the archive member name of a source file
+func memberName(srcDir, path string) string {
+	return strings.TrimPrefix(filepath.ToSlash(relPath(srcDir, path)), "/")
+}
+
+// archiveWriter writes the files of a run into an archive, one at a time.
+//
+// Every member of a tar.zst archive is a separate zstd frame starting at a
+// recorded offset, so a member can be read without decompressing the members
+// before it. The concatenated frames are still a regular tar.zst file.
+type archiveWriter struct {
+	name    string
+	format  string
+	options *Options
+	mu      sync.Mutex
+
+	w  *storageWriter
+	cw *countingWriter
+
+	// tar.zst
+	frame *frameWriter
+	tw    *tar.Writer
+	level zstd.EncoderLevel
+
+	// zip
+	zw *zip.Writer
+}
+
+// newArchiveWriter starts an archive stored under name when it is closed
+func newArchiveWriter(storage Storage, name, format string, options *Options) (*archiveWriter, error) {
+	if err := checkArchive(format, options.CompressionLevel); err != nil {
+		return nil, err
+	}
+	w := putWriter(storage, name, time.Time{})
+	a := &archiveWriter{
+		name:    name,
+		format:  format,
+		options: options,
+		w:       w,
+		cw:      &countingWriter{w: w},
+		level:   zstd.SpeedDefault,
+	}
+	if options.CompressionLevel > 0 {
+		a.level = zstd.EncoderLevelFromZstd(options.CompressionLevel)
+	}
+
+	switch format {
+	case StorageTarZst:
+		a.frame = &frameWriter{}
+		a.tw = tar.NewWriter(a.frame)
+	case StorageZip:
+		a.zw = zip.NewWriter(a.cw)
+	}
+	return a, nil
+}
+
+// add writes a file into the archive and returns its member name and offset
+func (a *archiveWriter) add(fi *File, srcDir string) (string, int64, error) {
+	from, err := os.Open(fi.Path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer from.Close()
+	return a.write(fi, memberName(srcDir, fi.Path), from)
+}
+
+// write writes the content of a file read from r as a member
+func (a *archiveWriter) write(fi *File, member string, from io.Reader) (string, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.zw != nil {
+		method := zip.Store
+		if a.options.compressible(fi.Path) {
+			method = zip.Deflate
+		}
+		w, err := a.zw.CreateHeader(&zip.FileHeader{
+			Name:     member,
+			Method:   method,
+			Modified: fi.ModTime,
+		})
+		if err != nil {
+			return "", 0, err
+		}
+		_, err = io.Copy(w, from)
+		return member, 0, err
+	}
+
+	offset := a.cw.n
+	if err := a.startFrame(); err != nil {
+		return "", 0, err
+	}
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     member,
+		Size:     fi.Size,
+		Mode:     0644,
+		ModTime:  fi.ModTime,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The header promised fi.Size bytes. A file that shrank or could not be read is
+	// padded to keep the archive valid; only that file fails.
+	src := &sourceReader{r: from}
+	n, err := io.CopyN(a.tw, src, fi.Size)
+	if err == io.EOF {
+		err = errors.New("file changed during backup")
+	}
+	if err != nil && (src.err != nil || src.eof) {
+		if _, perr := io.CopyN(a.tw, zeroReader{}, fi.Size-n); perr != nil {
+			return "", 0, perr
+		}
+	}
+	if err := a.endFrame(); err != nil {
+		return "", 0, err
+	}
+	return member, offset, err
+}
+
+// sourceReader tells the errors of reading a file from those of writing the archive
+type sourceReader struct {
+	r   io.Reader
+	err error
+	eof bool
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	} else if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (a *archiveWriter) startFrame() error {
+	enc, err := zstd.NewWriter(a.cw, zstd.WithEncoderLevel(a.level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return err
+	}
+	a.frame.enc = enc
+	return nil
+}
+
+func (a *archiveWriter) endFrame() error {
+	if err := a.tw.Flush(); err != nil {
+		return err
+	}
+	return a.frame.enc.Close()
+}
+
+// close finishes the archive
+func (a *archiveWriter) close() error {
+	var err error
+	if a.zw != nil {
+		err = a.zw.Close()
+	} else if err = a.startFrame(); err == nil {
+		err = a.tw.Close()
+		if err == nil {
+			err = a.frame.enc.Close()
+		}
+	}
+	if err != nil {
+		a.w.abort(err)
+		return err
+	}
+	return a.w.Close()
+}
+
+// frameWriter passes the tar stream to the zstd frame being written
+type frameWriter struct {
+	enc *zstd.Encoder
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// openTarMember returns a reader of a member of a tar.zst archive written by archiveWriter
+func openTarMember(storage Storage, name string, offset int64, member string) (io.ReadCloser, error) {
+	f, err := storage.Get(name, offset)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	closeAll := func() error {
+		zr.Close()
+		return f.Close()
+	}
+
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err == nil && hdr.Name != member {
+		err = fmt.Errorf("unexpected archive member at %d: %s", offset, hdr.Name)
+	}
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("%s: %s", member, err.Error())
+	}
+	return &archiveMember{Reader: tr, close: closeAll}, nil
+}
+
+type archiveMember struct {
+	io.Reader
+	close func() error
+}
+
+func (m *archiveMember) Close() error {
+	return m.close()
+}
+
+// zipArchives keeps zip archives open while a catalog reads their members,
+// so that the central directory of an archive is read once
+type zipArchives struct {
+	mu   sync.Mutex
+	open map[string]*zipArchive
+}
+
+type zipArchive struct {
+	*zip.Reader
+	src io.Closer
+}
+
+func (z *zipArchives) member(storage Storage, name, member string) (io.ReadCloser, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	za, ok := z.open[name]
+	if !ok {
+		var err error
+		za, err = openZipArchive(storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if z.open == nil {
+			z.open = make(map[string]*zipArchive)
+		}
+		z.open[name] = za
+	}
+	return za.Open(member)
+}
+
+func openZipArchive(storage Storage, name string) (*zipArchive, error) {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	src, err := storage.Get(name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// Local files are read in place; other storages are read in blocks
+	ra, ok := src.(io.ReaderAt)
+	if !ok {
+		src.Close()
+		src = ioutil.NopCloser(nil)
+		ra = &storageReaderAt{storage: storage, name: name, size: info.Size}
+	}
+	zr, err := zip.NewReader(ra, info.Size)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return &zipArchive{Reader: zr, src: src}, nil
+}
+
+func (z *zipArchives) close() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	for name, za := range z.open {
+		za.src.Close()
+		delete(z.open, name)
+	}
+}
+
+const readerAtBlockSize = 1 << 20
+
+// storageReaderAt reads an object at random offsets, keeping the last block read
+type storageReaderAt struct {
+	storage Storage
+	name    string
+	size    int64
+
+	mu    sync.Mutex
+	off   int64
+	block []byte
+}
+
+func (r *storageReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		if pos < r.off || pos >= r.off+int64(len(r.block)) {
+			if err := r.readBlock(pos); err != nil {
+				return n, err
+			}
+		}
+		n += copy(p[n:], r.block[pos-r.off:])
+	}
+	return n, nil
+}
+
+func (r *storageReaderAt) readBlock(off int64) error {
+	size := r.size - off
+	if size > readerAtBlockSize {
+		size = readerAtBlockSize
+	}
+	src, err := r.storage.Get(r.name, off)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	block := make([]byte, size)
+	if _, err := io.ReadFull(src, block); err != nil {
+		return err
+	}
+	r.off, r.block = off, block
+	return nil
+}
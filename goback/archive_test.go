@@ -0,0 +1,95 @@
+package goback
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// failingReader returns data and then a read error
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) < 1 {
+		return 0, errors.New("input/output error")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// A file which fails or shrinks while it is read is padded, so that the members after it are intact
+func TestArchiveWriterReadError(t *testing.T) {
+	storage := newLocalStorage(t.TempDir())
+	a, err := newArchiveWriter(storage, "run.tar.zst", StorageTarZst, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := []struct {
+		name string
+		size int64
+		r    io.Reader
+		fail bool
+	}{
+		{"a.txt", 5, strings.NewReader("aaaaa"), false},
+		{"failed.bin", 100 << 10, &failingReader{data: bytes.Repeat([]byte("x"), 10<<10)}, true},
+		{"shrunk.txt", 10, strings.NewReader("short"), true},
+		{"b.txt", 5, strings.NewReader("bbbbb"), false},
+	}
+	offsets := make([]int64, len(members))
+	for i, m := range members {
+		fi := &File{Path: m.name, Size: m.size, ModTime: time.Now()}
+		_, offsets[i], err = a.write(fi, m.name, m.r)
+		if (err != nil) != m.fail {
+			t.Fatalf("%s: %v", m.name, err)
+		}
+	}
+	if err := a.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The whole archive
+	f, err := storage.Get("run.tar.zst", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for _, m := range members {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, tr)
+		if hdr.Name != m.name || n != m.size || err != nil {
+			t.Errorf("member %s: %s of %d bytes, %v", m.name, hdr.Name, n, err)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("end of archive: %v", err)
+	}
+
+	// The member after the failed ones
+	r, err := openTarMember(storage, "run.tar.zst", offsets[3], "b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != "bbbbb" {
+		t.Errorf("b.txt: %q, %v", data, err)
+	}
+}
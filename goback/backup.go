@@ -2,12 +2,15 @@ package goback
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,12 +21,50 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+const (
+	StorageFile  = ""      // Files are copied into the dated backup directory
+	StorageChunk = "chunk" // Files are stored as chunks under dstDir/chunks
+)
+
+// Backup states. Negative states have no data to restore.
+const (
+	StateStarted     = 1
+	StateInitialized = 2  // Written by older versions: initial data of the source was collected; no files were copied
+	StateCompleted   = 3  // Changed files were backed up
+	StatePartial     = 4  // Changed files were backed up, but some files failed
+	StateFailed      = -1 // Nothing was backed up
+	StateSkipped     = -2 // Not run by the daemon because the previous run of the job was still running
+	StateMissed      = -3 // Not run by the daemon because it was not running or asleep at the scheduled time
+)
+
 const (
 	FileModified = 1 << iota // 1
 	FileAdded    = 1 << iota // 2
 	FileDeleted  = 1 << iota // 4
+	FileMoved    = 1 << iota // 8; nothing is stored, the data is that of the old path
 )
 
+// StateName returns the name of a file state. Negative states are failures.
+func StateName(state int) string {
+	var name string
+	switch state {
+	case FileModified, -FileModified:
+		name = "M"
+	case FileAdded, -FileAdded:
+		name = "A"
+	case FileDeleted, -FileDeleted:
+		name = "D"
+	case FileMoved, -FileMoved:
+		name = "R"
+	default:
+		return strconv.Itoa(state)
+	}
+	if state < 0 {
+		return name + "(fail)"
+	}
+	return name
+}
+
 type Backup struct {
 	srcDir       string
 	dstDir       string
@@ -31,38 +72,126 @@ type Backup struct {
 	dbLogFile    string
 	dbFile       string
 	tempDir      string
+	dstInSrc     string
+	filter       *Filter
 	S            *Summary
+	Options      Options
 	debug        bool
 
 	dbOrigin   *sql.DB
 	dbOriginTx *sql.Tx
 	dbLog      *sql.DB
 	dbLogTx    *sql.Tx
+
+	chunks    *chunkStore
+	lock      *lock
+	journal   *journal
+	resumeDir string    // Temporary directory of the interrupted backup being resumed
+	copied    *sync.Map // Files copied by the interrupted backup
+	key       []byte    // Encryption key; nil if the destination is not encrypted
+	archive   *archiveWriter
+	storage   Storage
+	dirs      []*File // Directories of the source with their metadata
+
+	snapshot        *localStorage // Set in snapshot mode
+	prevSnapshot    string        // Storage name of the previous snapshot of the source
+	unchangedCopied uint32        // Unchanged files copied into the snapshot
+
+	moves  *moveIndex // Files of the last backup by size and mtime, to detect moves
+	failed []*File    // Paths the walk could not read
+}
+
+func defaultOptions() Options {
+	return Options{
+		Workers:   runtime.NumCPU(),
+		BatchSize: DefaultBatchSize,
+	}
+}
+
+type Options struct {
+	Job      string   // Name of the job; each job keeps its own baseline of a source
+	Dedup    bool     // Store files as deduplicated chunks under dstDir/chunks
+	Checksum bool     // Detect changes by content checksum as well as mtime and size
+	Workers  int      // Number of files compared and copied at the same time
+	Excludes []string // Gitignore-style patterns of paths not to back up
+	WaitLock bool     // Wait for another backup of the destination to finish instead of failing
+
+	BatchSize int // Rows written to the databases per insert statement
+
+	Compression      string   // Codec of stored copies: gzip, zstd or none
+	CompressionLevel int      // Level of the codec; 0 is its default
+	SkipCompress     []string // Extensions stored uncompressed in addition to known compressed formats
+
+	// Encrypts copies; required if the destination is encrypted. The catalogs are not
+	// encrypted. Validate rejects encryption with dedup, archives and snapshots.
+	Passphrase string
+	Archive    string // Write the changed files of a run into one archive: tar.zst or zip
+	Snapshot   bool   // Make every dated directory a complete tree; unchanged files are hard links
+	StorageURL string // Where copies are stored, e.g. s3://bucket/prefix; the backup directory if empty
+	DryRun     bool   // Walk and compare only; nothing is stored and neither database is written
+}
+
+// Validate checks the options and the combinations of them that are supported.
+// Both Initialize and the validation of job configurations use it.
+func (o *Options) Validate() error {
+	if err := checkBatchSize(o.BatchSize); err != nil {
+		return err
+	}
+	if err := checkCodec(o.Compression, o.CompressionLevel); err != nil {
+		return err
+	}
+	if o.Dedup && o.Compression != CodecNone {
+		return errors.New("compression is not supported with dedup")
+	}
+	if err := checkArchive(o.Archive, o.CompressionLevel); err != nil {
+		return err
+	}
+	if o.Archive != "" && (o.Dedup || o.Compression != CodecNone) {
+		return errors.New("archives cannot be combined with dedup or compression")
+	}
+	if o.Snapshot && (o.Dedup || o.Compression != CodecNone || o.Archive != "") {
+		return errors.New("snapshots cannot be combined with dedup, compression or archives")
+	}
+	if o.Passphrase != "" && (o.Dedup || o.Archive != "" || o.Snapshot) {
+		return errors.New("encryption is not supported with dedup, archives or snapshots")
+	}
+	if err := checkStorageURL(o.StorageURL); err != nil {
+		return err
+	}
+	_, err := NewFilter(o.Excludes)
+	return err
 }
 
 type Summary struct {
 	ID         int64
 	Date       time.Time
+	Job        string
 	SrcDir     string
 	DstDir     string
 	State      int
+	Storage    string
+	Pruned     bool
 	TotalSize  uint64
 	TotalCount uint32
 
 	BackupAdded    uint32
 	BackupModified uint32
 	BackupDeleted  uint32
+	BackupMoved    uint32
 
 	BackupSuccess uint32
 	BackupFailure uint32
 
 	BackupSize uint64
+	Excluded   uint32
 	Message    string
 
 	ReadingTime    time.Time
 	ComparisonTime time.Time
 	LoggingTime    time.Time
 	ExecutionTime  float64
+
+	Changes []*File // Files a dry run would back up or mark deleted, sorted by path
 }
 
 func newSummary(lastId int64, srcDir string) *Summary {
@@ -70,17 +199,34 @@ func newSummary(lastId int64, srcDir string) *Summary {
 		ID:     lastId,
 		Date:   time.Now(),
 		SrcDir: srcDir,
-		State:  1,
+		State:  StateStarted,
 	}
 }
 
 type File struct {
-	Path    string
-	Size    int64
-	ModTime time.Time
-	Result  int
-	State   int
-	Message string
+	Path      string
+	Size      int64
+	ModTime   time.Time
+	Result    int
+	State     int
+	Message   string
+	Hash      string
+	Codec     string
+	Encrypted bool
+	Member    string // Archive member name
+	Offset    int64  // Offset of the member in a tar.zst archive
+	Chunks    []Chunk
+
+	Mode      os.FileMode
+	Uid       int
+	Gid       int
+	Link      string // Target of a symlink
+	Xattrs    map[string][]byte
+	XattrHash string // Checksum of the extended attributes; empty if unknown
+
+	OldPath string // Path the file was moved from
+
+	last *File // Baseline data of a modified file, kept if its copy fails
 }
 
 func newFile(path string, size int64, modTime time.Time) *File {
@@ -98,6 +244,7 @@ func NewBackup(srcDir, dstDir string, debug bool) *Backup {
 		dstDir:       filepath.Clean(dstDir),
 		dbOriginFile: filepath.Join(filepath.Clean(dstDir), "backup_origin.db"),
 		dbLogFile:    filepath.Join(filepath.Clean(dstDir), "backup_log.db"),
+		Options:      defaultOptions(),
 		debug:        debug,
 	}
 	return &b
@@ -105,7 +252,18 @@ func NewBackup(srcDir, dstDir string, debug bool) *Backup {
 
 // Initialize
 func (b *Backup) Initialize() error {
-	var err error
+	err := b.Options.Validate()
+	if err != nil {
+		return err
+	}
+	b.filter, err = NewFilter(b.Options.Excludes)
+	if err != nil {
+		return err
+	}
+	if b.Options.DryRun {
+		return b.initDryRun()
+	}
+
 	err = b.initDir()
 	if err != nil {
 		return err
@@ -113,18 +271,152 @@ func (b *Backup) Initialize() error {
 
 	err = b.initDB()
 	if err != nil {
+		b.abort()
+		return err
+	}
+
+	b.key, err = initKey(b.dstDir, b.Options.Passphrase)
+	if err != nil {
+		b.abort()
+		return err
+	}
+
+	storage, err := b.initStorage()
+	if err != nil {
+		b.abort()
+		return err
+	}
+	b.storage = storage
+
+	b.initSummary()
+	if b.Options.Dedup {
+		b.chunks = newChunkStore(b.storage)
+	}
+	if b.Options.Snapshot {
+		if err := b.initSnapshot(); err != nil {
+			b.abort()
+			return err
+		}
+	}
+
+	err = b.initJournal()
+	if err != nil {
+		b.abort()
 		return err
 	}
 
+	return nil
+}
+
+func (b *Backup) initSummary() {
 	if b.debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
 	b.S = newSummary(0, b.srcDir)
+	b.S.Job = b.Options.Job
+	if b.Options.Workers < 1 {
+		b.Options.Workers = 1
+	}
+	if b.Options.Dedup {
+		b.S.Storage = StorageChunk
+	}
+	if b.Options.Archive != "" {
+		b.S.Storage = b.Options.Archive
+	}
+	if b.Options.Snapshot {
+		b.S.Storage = StorageSnapshot
+	}
+}
+
+// initDryRun opens the databases read-only. The destination is neither locked nor written,
+// and a destination without databases is previewed as a first backup.
+func (b *Backup) initDryRun() error {
+	if _, err := os.Stat(b.srcDir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(b.dstDir); err != nil {
+		return err
+	}
+	b.findDstInSrc()
+
+	if _, err := os.Stat(b.dbLogFile); err == nil {
+		if _, err := os.Stat(b.dbOriginFile); err == nil {
+			b.dbOrigin, err = sql.Open("sqlite3", "file:"+b.dbOriginFile+"?mode=ro")
+			if err != nil {
+				return err
+			}
+			b.dbLog, err = sql.Open("sqlite3", "file:"+b.dbLogFile+"?mode=ro")
+			if err != nil {
+				b.dbOrigin.Close()
+				return err
+			}
+		}
+	}
 
+	b.initSummary()
+	log.Info("dry run; nothing will be stored")
 	return nil
 }
 
+// initStorage opens the storage of the backup directory. A new backup directory
+// records the storage location given in the options.
+func (b *Backup) initStorage() (Storage, error) {
+	location, err := getMeta(b.dbLog, metaStorageURL)
+	if err != nil {
+		return nil, err
+	}
+	if b.Options.StorageURL != "" && b.Options.StorageURL != location {
+		if location != "" {
+			return nil, fmt.Errorf("backup directory stores copies in %s", location)
+		}
+		var count int
+		if err := b.dbLog.QueryRow("select count(*) from bak_summary where state > 0 and dst_dir != ''").Scan(&count); err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return nil, errors.New("backup directory already stores copies locally")
+		}
+
+		storage, err := OpenStorage(b.Options.StorageURL, b.dstDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := setMeta(b.dbLog, metaStorageURL, b.Options.StorageURL); err != nil {
+			storage.Close()
+			return nil, err
+		}
+		return storage, nil
+	}
+	return OpenStorage(location, b.dstDir)
+}
+
+// abort releases what Initialize acquired when it fails. Nothing is written to the databases.
+func (b *Backup) abort() {
+	if b.dbOriginTx != nil {
+		b.dbOriginTx.Rollback()
+	}
+	if b.dbLogTx != nil {
+		b.dbLogTx.Rollback()
+	}
+	if b.dbOrigin != nil {
+		b.dbOrigin.Close()
+	}
+	if b.dbLog != nil {
+		b.dbLog.Close()
+	}
+	if b.storage != nil {
+		if err := b.storage.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+	if b.resumeDir == "" {
+		os.RemoveAll(b.tempDir)
+		os.Remove(journalPath(b.tempDir))
+	}
+	b.lock.release()
+}
+
 // Initialize directories
 func (b *Backup) initDir() error {
 	if _, err := os.Stat(b.srcDir); os.IsNotExist(err) {
@@ -135,15 +427,104 @@ func (b *Backup) initDir() error {
 		return err
 	}
 
-	tempDir, err := ioutil.TempDir(b.dstDir, "bak")
+	lock, err := acquireLock(b.dstDir, b.Options.WaitLock)
 	if err != nil {
 		return err
 	}
-	b.tempDir = tempDir
+	b.lock = lock
+
+	if b.resumeDir != "" {
+		if _, err := os.Stat(b.resumeDir); err != nil {
+			b.lock.release()
+			return err
+		}
+		b.tempDir = b.resumeDir
+	} else {
+		b.reportInterrupted()
+		tempDir, err := ioutil.TempDir(b.dstDir, "bak")
+		if err != nil {
+			b.lock.release()
+			return err
+		}
+		b.tempDir = tempDir
+	}
+	b.findDstInSrc()
 
 	return nil
 }
 
+// findDstInSrc finds the destination directory inside the source directory, which is not backed up
+func (b *Backup) findDstInSrc() {
+	absSrc, _ := filepath.Abs(b.srcDir)
+	absDst, _ := filepath.Abs(b.dstDir)
+	if rel, err := filepath.Rel(absSrc, absDst); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+		b.dstInSrc = filepath.Join(b.srcDir, rel)
+	}
+}
+
+// reportInterrupted warns of temporary directories left by backups which did not finish
+func (b *Backup) reportInterrupted() {
+	if err := removeStaleJournals(b.dstDir); err != nil {
+		log.Error(err)
+	}
+	runs, err := findInterrupted(b.dstDir)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, r := range runs {
+		log.Warnf("interrupted backup: %s; %d files copied; run resume to resume or roll it back", r, r.Copied)
+	}
+}
+
+// initJournal starts the journal of the backup or loads the journal of the backup being resumed
+func (b *Backup) initJournal() error {
+	var err error
+	if b.resumeDir == "" {
+		b.journal, err = createJournal(b.tempDir, journalHeader{
+			Job:      b.S.Job,
+			SrcDir:   b.srcDir,
+			Date:     b.S.Date,
+			Dedup:    b.Options.Dedup,
+			Checksum: b.Options.Checksum,
+			Excludes: b.Options.Excludes,
+
+			Compression:      b.Options.Compression,
+			CompressionLevel: b.Options.CompressionLevel,
+			SkipCompress:     b.Options.SkipCompress,
+			Archive:          b.Options.Archive,
+			Snapshot:         b.Options.Snapshot,
+		})
+		return err
+	}
+
+	header, entries, err := readJournal(b.tempDir)
+	if err != nil {
+		return err
+	}
+	if header.Job != b.S.Job || header.SrcDir != b.srcDir {
+		return fmt.Errorf("%s is a backup of %s", b.tempDir, header.SrcDir)
+	}
+	b.S.Message = "resumed; "
+
+	// Files being stored when the backup was interrupted
+	if err := deletePrefix(b.storage, putTempDir); err != nil {
+		return err
+	}
+
+	// An archive is written again from the start
+	if b.Options.Archive == "" {
+		b.copied = &sync.Map{}
+		for path, e := range entries {
+			b.copied.Store(path, e)
+		}
+	}
+	log.Infof("resuming backup started at %s; %d files already copied", header.Date.Format(time.RFC3339), len(entries))
+
+	b.journal, err = openJournal(b.tempDir)
+	return err
+}
+
 // Initialize database
 func (b *Backup) initDB() error {
 	var err error
@@ -154,12 +535,18 @@ func (b *Backup) initDB() error {
 	if err != nil {
 		return err
 	}
-	b.dbOriginTx, _ = b.dbOrigin.Begin()
+	b.dbOriginTx, err = b.dbOrigin.Begin()
+	if err != nil {
+		return err
+	}
 	b.dbLog, err = sql.Open("sqlite3", b.dbLogFile)
 	if err != nil {
 		return err
 	}
-	b.dbLogTx, _ = b.dbLog.Begin()
+	b.dbLogTx, err = b.dbLog.Begin()
+	if err != nil {
+		return err
+	}
 
 	// Original database
 	query = `
@@ -173,9 +560,79 @@ func (b *Backup) initDB() error {
 	if err != nil {
 		return err
 	}
+	err = addColumn(b.dbOrigin, "bak_origin", "hash", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "src_dir", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "job", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "mode", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "uid", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "gid", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "link", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(b.dbOrigin, "bak_origin", "xattr_hash", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	_, err = b.dbOrigin.Exec(`
+		DROP INDEX IF EXISTS ix_bak_origin_src_dir;
+		CREATE INDEX IF NOT EXISTS ix_bak_origin_source on bak_origin(job, src_dir);
+	`)
+	if err != nil {
+		return err
+	}
 
 	// Log database
-	query = `
+	err = initLogDB(b.dbLog)
+	if err != nil {
+		return err
+	}
+
+	return b.migrateOrigin()
+}
+
+// migrateOrigin assigns data written before baselines were kept per source to the source of the last backup
+func (b *Backup) migrateOrigin() error {
+	var count int
+	err := b.dbOrigin.QueryRow("select count(*) from bak_origin where src_dir = ''").Scan(&count)
+	if err != nil || count < 1 {
+		return err
+	}
+
+	var srcDir string
+	err = b.dbLog.QueryRow("select src_dir from bak_summary where id = (select max(id) from bak_summary where state > 0)").Scan(&srcDir)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Infof("assigning %d files of the last backup to %s", count, srcDir)
+	_, err = b.dbOrigin.Exec("update bak_origin set src_dir = ? where src_dir = ''", srcDir)
+	return err
+}
+
+// initLogDB creates and upgrades the tables of the log database
+func initLogDB(db *sql.DB) error {
+	query := `
 		CREATE TABLE IF NOT EXISTS bak_summary (
 			id integer not null primary key autoincrement,
 			date integer not null  DEFAULT CURRENT_TIMESTAMP,
@@ -206,213 +663,633 @@ func (b *Backup) initDB() error {
 		);
 
 		CREATE INDEX IF NOT EXISTS ix_bak_log_id on bak_log(id);
-`
-	_, err = b.dbLog.Exec(query)
-	if err != nil {
-		return err
-	}
 
-	return nil
-}
+		CREATE TABLE IF NOT EXISTS bak_chunk(
+			id int not null,
+			path text not null,
+			seq int not null,
+			hash text not null,
+			size int not null
+		);
 
-func (b *Backup) getOriginMap(summary *Summary) (sync.Map, int) {
-	m := sync.Map{}
-	if summary.ID < 1 {
-		log.Info("this is first backup")
-		return m, 0
-	}
-	log.Infof("recent backup: %s", summary.Date)
+		CREATE INDEX IF NOT EXISTS ix_bak_chunk_id on bak_chunk(id, path);
 
-	//The most recent backup was completed on May 5.
-	// Recent backups were processed on May 5th.
-	rows, err := b.dbOrigin.Query("select path, size, mtime from bak_origin")
-	checkErr(err)
+		CREATE TABLE IF NOT EXISTS bak_verify(
+			id integer not null primary key autoincrement,
+			backup_id int not null,
+			date text not null,
+			checked int not null,
+			missing int not null,
+			corrupted int not null,
+			state int not null,
+			message text not null
+		);
 
-	var count = 0
-	var path string
-	var size int64
-	var modTime string
-	for rows.Next() {
-		f := newFile("", 0, time.Now())
-		err = rows.Scan(&path, &size, &modTime)
-		checkErr(err)
-		f.Path = path
-		f.Size = size
-		f.ModTime, _ = time.Parse(time.RFC3339, modTime)
-		m.Store(path, f)
-		count += 1
-	}
-	return m, count
-}
+		CREATE INDEX IF NOT EXISTS ix_bak_verify_backup_id on bak_verify(backup_id);
 
-func (b *Backup) Start() error {
-	log.Infof("source directory: %s", b.srcDir)
+		CREATE TABLE IF NOT EXISTS bak_meta(
+			name text not null primary key,
+			value text not null
+		);
 
-	// Load last backup data
-	lastSummary := b.getLastSummary()
-	originMap, originCount := b.getOriginMap(lastSummary)
-
-	// Write initial data to database
-	newMap := sync.Map{}
-	if originCount < 1 || b.srcDir != lastSummary.SrcDir {
-		b.S.State = 2
-		b.S.Message = "collecting initialize data"
-		log.Info(b.S.Message)
-
-		err := filepath.Walk(b.srcDir, func(path string, f os.FileInfo, err error) error {
-			if !f.IsDir() {
-				fi := newFile(path, f.Size(), f.ModTime())
-				newMap.Store(path, fi)
-				b.S.TotalCount += 1
-				b.S.TotalSize += uint64(f.Size())
-			}
-			return nil
-		})
-		checkErr(err)
-		os.RemoveAll(b.tempDir)
-		b.S.ReadingTime = time.Now()
-		b.S.ComparisonTime = b.S.ReadingTime
+		CREATE TABLE IF NOT EXISTS bak_dir(
+			id int not null,
+			path text not null,
+			mode int not null,
+			uid int not null,
+			gid int not null,
+			mtime text not null,
+			xattrs text not null
+		);
 
-		log.Infof("writing initial data")
-		b.writeToDatabase(newMap, sync.Map{})
-		b.S.LoggingTime = time.Now()
-		return nil
+		CREATE INDEX IF NOT EXISTS ix_bak_dir_id on bak_dir(id);
+`
+	_, err := db.Exec(query)
+	if err != nil {
+		return err
 	}
-	b.S.ReadingTime = time.Now()
-
-	// Search files and compare with previous data
-	log.Infof("comparing old and new")
-	b.S.State = 3
-	i := 1
-	err := filepath.Walk(b.srcDir, func(path string, f os.FileInfo, err error) error {
-		if !f.IsDir() && f.Mode().IsRegular() {
-
-			log.Debugf("Start checking: [%d] %s (%d)", i, path, f.Size())
-			atomic.AddUint32(&b.S.TotalCount, 1)
-			atomic.AddUint64(&b.S.TotalSize, uint64(f.Size()))
-			fi := newFile(path, f.Size(), f.ModTime())
-
-			if inf, ok := originMap.Load(path); ok {
-				last := inf.(*File)
-
-				if last.ModTime.Unix() != f.ModTime().Unix() || last.Size != f.Size() {
-					log.Debugf("modified: %s", path)
-					fi.State = FileModified
-					atomic.AddUint32(&b.S.BackupModified, 1)
-					backupPath, dur, err := b.BackupFile(path)
-					if err != nil {
-						atomic.AddUint32(&b.S.BackupFailure, 1)
-						log.Error(err)
-						fi.Message = err.Error()
-						fi.State = fi.State * -1
-						//spew.Dump(fi)
-					} else {
-						fi.Message = fmt.Sprintf("copy_time=%4.1f", dur)
-						atomic.AddUint32(&b.S.BackupSuccess, 1)
-						atomic.AddUint64(&b.S.BackupSize, uint64(f.Size()))
-						os.Chtimes(backupPath, f.ModTime(), f.ModTime())
-						originMap.Delete(path)
-					}
-				}
-				originMap.Delete(path)
-			} else {
-				log.Debugf("added: %s", path)
-				fi.State = FileAdded
-				atomic.AddUint32(&b.S.BackupAdded, 1)
-				backupPath, dur, err := b.BackupFile(path)
-				if err != nil {
-					atomic.AddUint32(&b.S.BackupFailure, 1)
-					log.Error(err)
-					fi.Message = err.Error()
-					fi.State = fi.State * -1
-					//spew.Dump(fi)
-				} else {
-					fi.Message = fmt.Sprintf("copy_time=%4.1f", dur)
-					atomic.AddUint32(&b.S.BackupSuccess, 1)
-					atomic.AddUint64(&b.S.BackupSize, uint64(f.Size()))
-					os.Chtimes(backupPath, f.ModTime(), f.ModTime())
-				}
-			}
-			//if fi.State < 0 {
-			//	log.Debugf("[%d] %s", fi.State, fi.Path)
-			//}
-			newMap.Store(path, fi)
-			i++
-		}
-		return nil
-	})
-	checkErr(err)
-
-	// Rename directory
-	lastDir := filepath.Join(b.dstDir, b.S.Date.Format("20060102"))
-	err = os.Rename(b.tempDir, lastDir)
-	if err == nil {
-		b.S.DstDir = lastDir
-	} else {
 
-		i := 1
-		for err != nil && i <= 10 {
-			altDir := lastDir + "_" + strconv.Itoa(i)
-			err = os.Rename(b.tempDir, altDir)
-			if err == nil {
-				b.S.DstDir = altDir
-			}
-			i += 1
-		}
-		if err != nil {
-			b.S.Message = err.Error()
-			b.S.State = -1
-			b.S.DstDir = b.tempDir
-			os.RemoveAll(b.tempDir)
-			return err
-		}
+	err = addColumn(db, "bak_summary", "storage", "text not null default ''")
+	if err != nil {
+		return err
 	}
-	b.S.ComparisonTime = time.Now()
+	err = addColumn(db, "bak_summary", "pruned", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_summary", "excluded", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_summary", "job", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_summary", "backup_moved", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS ix_bak_summary_source ON bak_summary(job, src_dir)")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "hash", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "codec", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "encrypted", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "member", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "member_offset", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "mode", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "uid", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "gid", "integer not null default 0")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "link", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	err = addColumn(db, "bak_log", "xattrs", "text not null default ''")
+	if err != nil {
+		return err
+	}
+	return addColumn(db, "bak_log", "old_path", "text not null default ''")
+}
+
+// addColumn adds a column to a table created by an older version
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("pragma table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(cols))
+	var name string
+	for rows.Next() {
+		for i := range values {
+			values[i] = new(interface{})
+		}
+		values[1] = &name
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, definition))
+	return err
+}
+
+func (b *Backup) getOriginMap(summary *Summary) (*sync.Map, error) {
+	m := &sync.Map{}
+	// The first backup of a source has no baseline, so it stores every file
+	if summary.ID < 1 {
+		log.Info("this is first backup")
+		return m, nil
+	}
+	log.Infof("recent backup: %s", summary.Date)
+
+	//The most recent backup was completed on May 5.
+	// Recent backups were processed on May 5th.
+	rows, err := b.dbOrigin.Query("select path, size, mtime, hash, mode, uid, gid, link, xattr_hash from bak_origin where job = ? and src_dir = ?", b.S.Job, b.srcDir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var path string
+	var size int64
+	var modTime string
+	for rows.Next() {
+		f := newFile("", 0, time.Now())
+		if err := rows.Scan(&path, &size, &modTime, &f.Hash, &f.Mode, &f.Uid, &f.Gid, &f.Link, &f.XattrHash); err != nil {
+			return nil, err
+		}
+		f.Path = path
+		f.Size = size
+		f.ModTime, _ = time.Parse(time.RFC3339, modTime)
+		m.Store(path, f)
+	}
+	return m, rows.Err()
+}
+
+func (b *Backup) Start() error {
+	log.Infof("source directory: %s", b.srcDir)
+
+	// Load last backup data
+	lastSummary, err := b.getLastSummary()
+	if err != nil {
+		return b.fail(err)
+	}
+	originMap, err := b.getOriginMap(lastSummary)
+	if err != nil {
+		return b.fail(err)
+	}
+
+	newMap := &sync.Map{}
+	b.S.ReadingTime = time.Now()
+
+	// Search files and compare with previous data; workers compare and copy while walking
+	log.Infof("comparing old and new")
+	b.S.State = StateCompleted
+	if b.snapshot != nil {
+		if err := b.findPrevSnapshot(lastSummary); err != nil {
+			return b.fail(err)
+		}
+	}
+	if isArchive(b.S.Storage) && !b.Options.DryRun {
+		archive, err := newArchiveWriter(b.storage, filepath.Base(b.tempDir)+"/archive."+b.S.Storage, b.S.Storage, &b.Options)
+		if err != nil {
+			return b.fail(err)
+		}
+		b.archive = archive
+	}
+	b.moves = newMoveIndex(originMap)
+	files := make(chan *File, b.Options.Workers*2)
+	wg := sync.WaitGroup{}
+	for i := 0; i < b.Options.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fi := range files {
+				b.compare(fi, originMap)
+				newMap.Store(fi.Path, fi)
+			}
+		}()
+	}
+	err = b.walk(func(path string, f os.FileInfo, err error) error {
+		if err != nil {
+			return b.walkFailed(path, f, err, originMap)
+		}
+		if f.IsDir() {
+			b.addDir(path, f)
+			return nil
+		}
+		if backedUp(f.Mode()) {
+			atomic.AddUint32(&b.S.TotalCount, 1)
+			atomic.AddUint64(&b.S.TotalSize, uint64(f.Size()))
+			files <- newFileInfo(path, f)
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if err != nil {
+		if b.archive != nil {
+			b.archive.close()
+		}
+		return b.fail(err)
+	}
+	b.keepUnread(originMap, newMap)
+	b.resolveMoves(originMap)
+	if b.Options.DryRun {
+		b.collectChanges(newMap, originMap)
+		b.S.ComparisonTime = time.Now()
+		b.S.LoggingTime = b.S.ComparisonTime
+		return b.result()
+	}
+	if b.snapshot != nil {
+		b.snapshotDirs()
+	}
+	b.removeUnusedCopies()
+
+	// Rename directory, or move the archive out of it
+	from, ext := filepath.Base(b.tempDir), ""
+	if b.archive != nil {
+		err = b.archive.close()
+		from, ext = b.archive.name, "."+b.S.Storage
+	}
+	var name string
+	if err == nil {
+		name, err = b.datedName(ext)
+	}
+	if err == nil {
+		b.S.DstDir = filepath.Join(b.dstDir, name)
+		err = b.storage.Rename(from, name)
+		if err != nil {
+			// The name was free, so whatever was moved belongs to this run
+			b.discard()
+		}
+	}
+	if err != nil {
+		return b.fail(err)
+	}
+	os.RemoveAll(b.tempDir)
+	b.S.ComparisonTime = time.Now()
 
 	// Write data to database
-	err = b.writeToDatabase(newMap, originMap)
+	b.setPartial()
+	if err := b.writeToDatabase(newMap, originMap); err != nil {
+		b.discard()
+		return b.fail(err)
+	}
 	b.S.LoggingTime = time.Now()
+	return b.result()
+}
+
+// datedName returns the first name of the backup date used by neither the storage nor
+// the catalog: 20060102, 20060102_1, 20060102_2 and so on, as a day can have many runs.
+func (b *Backup) datedName(ext string) (string, error) {
+	date := b.S.Date.Format("20060102")
+	for i := 0; ; i++ {
+		name := date
+		if i > 0 {
+			name += "_" + strconv.Itoa(i)
+		}
+		name += ext
+
+		used, err := b.nameUsed(name)
+		if err != nil {
+			return "", err
+		}
+		if !used {
+			return name, nil
+		}
+	}
+}
+
+// nameUsed tells whether a backup has the name or anything is stored under it.
+// Pruned backups keep their names, so that pruning them again touches nothing new.
+func (b *Backup) nameUsed(name string) (bool, error) {
+	var count int
+	err := b.dbLog.QueryRow("select count(*) from bak_summary where dst_dir = ?", filepath.Join(b.dstDir, name)).Scan(&count)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+	if _, err := b.storage.Stat(name); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	objects, err := b.storage.List(name + "/")
+	if err != nil {
+		return false, err
+	}
+	return len(objects) > 0, nil
+}
+
+// fail ends the run as failed. The temporary directory is deleted; the databases are
+// rolled back by Close, so that nothing of the run is kept.
+func (b *Backup) fail(err error) error {
+	b.S.Message = err.Error()
+	b.S.State = StateFailed
+	if b.Options.DryRun {
+		return err
+	}
+	os.RemoveAll(b.tempDir)
+	if b.storage != nil {
+		if err := deletePrefix(b.storage, filepath.Base(b.tempDir)); err != nil {
+			log.Error(err)
+		}
+	}
 	return err
 }
 
-func (b *Backup) getLastSummary() *Summary {
-	log.Info("checking last backup data")
+// discard deletes the dated directory or archive of a run which could not be logged
+func (b *Backup) discard() {
+	name := filepath.Base(b.S.DstDir)
+	var err error
+	if isArchive(b.S.Storage) {
+		err = b.storage.Delete(name)
+	} else {
+		err = deletePrefix(b.storage, name)
+		removeEmptyDirs(b.S.DstDir)
+	}
+	if err != nil {
+		log.Error(err)
+	}
+	b.S.DstDir = ""
+}
 
-	rows, _ := b.dbLog.Query(`
-		select id, date, src_dir
-		from bak_summary
-		where id = (select max(id) from bak_summary)
-	`)
-	defer rows.Close()
+// setPartial marks a run with failed files as partial
+func (b *Backup) setPartial() {
+	if b.S.BackupFailure > 0 && b.S.State > 0 {
+		b.S.State = StatePartial
+	}
+}
+
+// result returns a PartialError if files of the run failed
+func (b *Backup) result() error {
+	if b.S.BackupFailure > 0 {
+		b.setPartial()
+		return &PartialError{Failed: b.S.BackupFailure}
+	}
+	return nil
+}
+
+// walkFailed records a path which could not be read as a failure. The files of the
+// last backup under it are kept by keepUnread. An unreadable source directory is fatal.
+func (b *Backup) walkFailed(path string, f os.FileInfo, err error, originMap *sync.Map) error {
+	if path == b.srcDir {
+		return err
+	}
+	log.Error(&FileError{Path: path, Err: err})
+
+	fi := newFile(path, 0, time.Time{})
+	fi.State = -FileAdded
+	fi.Message = err.Error()
+	if f != nil {
+		fi.Mode = f.Mode()
+	}
+	if inf, ok := originMap.Load(path); ok {
+		last := inf.(*File)
+		fi.Size, fi.ModTime = last.Size, last.ModTime
+		fi.State = -FileModified
+	}
+	b.failed = append(b.failed, fi)
+	atomic.AddUint32(&b.S.BackupFailure, 1)
+	return nil
+}
+
+// keepUnread keeps the files of the last backup at or under the paths the walk could not
+// read in the baseline, so that they are taken as neither deleted nor moved. It runs once
+// after the walk, looking up the parents of every file in the set of failed paths.
+func (b *Backup) keepUnread(originMap, newMap *sync.Map) {
+	if len(b.failed) < 1 {
+		return
+	}
+	failed := make(map[string]bool, len(b.failed))
+	for _, f := range b.failed {
+		failed[f.Path] = true
+	}
+	originMap.Range(func(key, value interface{}) bool {
+		for p := key.(string); p != b.srcDir && p != filepath.Dir(p); p = filepath.Dir(p) {
+			if failed[p] {
+				newMap.Store(key, value)
+				originMap.Delete(key)
+				break
+			}
+		}
+		return true
+	})
+}
+
+// addDir keeps the metadata of a directory below the source directory
+func (b *Backup) addDir(path string, f os.FileInfo) {
+	if path == b.srcDir || b.Options.DryRun {
+		return
+	}
+	d := newFileInfo(path, f)
+	xattrs, err := readXattrs(path)
+	if err != nil {
+		log.Debugf("%s: %s", path, err.Error())
+	}
+	d.Xattrs = xattrs
+	b.dirs = append(b.dirs, d)
+}
+
+// collectChanges keeps the files a dry run found added, modified or deleted
+func (b *Backup) collectChanges(newMap, originMap *sync.Map) {
+	newMap.Range(func(key, value interface{}) bool {
+		if f := value.(*File); f.State != 0 {
+			b.S.Changes = append(b.S.Changes, f)
+		}
+		return true
+	})
+	b.S.Changes = append(b.S.Changes, b.failed...)
+	originMap.Range(func(key, value interface{}) bool {
+		f := value.(*File)
+		f.State = FileDeleted
+		b.S.Changes = append(b.S.Changes, f)
+		b.S.BackupDeleted++
+		return true
+	})
+	sort.Slice(b.S.Changes, func(i, j int) bool {
+		return b.S.Changes[i].Path < b.S.Changes[j].Path
+	})
+}
+
+// walk walks the source directory, skipping excluded paths and the destination directory.
+// f is nil if a path could not be read.
+func (b *Backup) walk(fn filepath.WalkFunc) error {
+	return filepath.Walk(b.srcDir, func(path string, f os.FileInfo, err error) error {
+		if path == b.srcDir {
+			return fn(path, f, err)
+		}
+
+		isDir := f != nil && f.IsDir()
+		if isDir && path == b.dstInSrc {
+			log.Infof("skipping destination directory: %s", path)
+			return filepath.SkipDir
+		}
+		if b.filter.Excluded(relPath(b.srcDir, path), isDir) {
+			if err != nil {
+				return nil
+			}
+			log.Debugf("excluded: %s", path)
+			atomic.AddUint32(&b.S.Excluded, 1)
+			if isDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return fn(path, f, err)
+	})
+}
+
+// compare compares a file with its last backup data and stores it if it is added or modified
+func (b *Backup) compare(fi *File, originMap *sync.Map) {
+	log.Debugf("Start checking: %s (%d)", fi.Path, fi.Size)
+	if b.Options.Checksum {
+		hash, err := hashFile(fi.Path)
+		if err != nil {
+			b.hashFailed(fi, err, originMap)
+			return
+		}
+		fi.Hash = hash
+	}
+	readFileXattrs(fi)
+
+	if inf, ok := originMap.Load(fi.Path); ok {
+		last := inf.(*File)
+
+		if isModified(last, fi) {
+			log.Debugf("modified: %s", fi.Path)
+			fi.State = FileModified
+			fi.last = last
+			atomic.AddUint32(&b.S.BackupModified, 1)
+			b.storeChanged(fi)
+		} else if b.snapshot != nil {
+			// A file missing from the snapshot fails like a failed copy
+			if err := b.linkUnchanged(fi); err != nil {
+				atomic.AddUint32(&b.S.BackupFailure, 1)
+				log.Error(err)
+				fi.Message = err.Error()
+				fi.State = -FileModified
+				fi.last = last
+			}
+		}
+		originMap.Delete(fi.Path)
+		return
+	}
+
+	if b.moves.hold(fi, originMap) {
+		return
+	}
+	b.storeAdded(fi)
+}
+
+// hashFailed records a file whose checksum could not be computed as failed. Its last
+// baseline data is kept, so that the next backup tries again.
+func (b *Backup) hashFailed(fi *File, err error, originMap *sync.Map) {
+	atomic.AddUint32(&b.S.BackupFailure, 1)
+	log.Error(&FileError{Path: fi.Path, Err: err})
+	fi.Message = err.Error()
+	fi.State = -FileAdded
+	if inf, ok := originMap.LoadAndDelete(fi.Path); ok {
+		fi.State = -FileModified
+		fi.last = inf.(*File)
+	}
+}
+
+// storeAdded stores a file which is not in the last backup
+func (b *Backup) storeAdded(fi *File) {
+	log.Debugf("added: %s", fi.Path)
+	fi.State = FileAdded
+	atomic.AddUint32(&b.S.BackupAdded, 1)
+	b.storeChanged(fi)
+}
+
+// storeChanged stores a modified or added file. A file which cannot be stored is failed.
+func (b *Backup) storeChanged(fi *File) {
+	dur, err := b.store(fi)
+	if err != nil {
+		atomic.AddUint32(&b.S.BackupFailure, 1)
+		log.Error(err)
+		fi.Message = err.Error()
+		fi.State = fi.State * -1
+		//spew.Dump(fi)
+	} else {
+		fi.Message = fmt.Sprintf("copy_time=%4.1f", dur)
+		atomic.AddUint32(&b.S.BackupSuccess, 1)
+		atomic.AddUint64(&b.S.BackupSize, uint64(fi.Size))
+	}
+}
+
+// isModified compares a file with its last backup data.
+// Checksums are compared only when both are known.
+func isModified(last, fi *File) bool {
+	if last.ModTime.Unix() != fi.ModTime.Unix() || last.Size != fi.Size || metadataChanged(last, fi) {
+		return true
+	}
+	return last.Hash != "" && fi.Hash != "" && last.Hash != fi.Hash
+}
+
+func (b *Backup) getLastSummary() (*Summary, error) {
+	log.Info("checking last backup data")
+	if b.dbLog == nil {
+		return newSummary(0, ""), nil
+	}
 
 	var lastId int64
 	var date string
 	var srcDir string
-	rows.Next()
-	rows.Scan(&lastId, &date, &srcDir)
+	err := b.dbLog.QueryRow(`
+		select id, date, src_dir
+		from bak_summary
+		where id = (select max(id) from bak_summary where job = ? and src_dir = ? and state > 0)
+	`, b.S.Job, b.srcDir).Scan(&lastId, &date, &srcDir)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
 
 	s := newSummary(lastId, srcDir)
 	s.Date, _ = time.Parse(time.RFC3339, date)
 
-	return s
+	return s, nil
 }
 
-func (b *Backup) writeToDatabase(newMap sync.Map, originMap sync.Map) error {
+func (b *Backup) writeToDatabase(newMap, originMap *sync.Map) error {
 	log.Info("writing to database")
 
-	rs, err := b.dbLogTx.Exec("insert into bak_summary(date,src_dir,dst_dir,state,total_size,total_count,backup_modified,backup_added,backup_deleted,backup_success,backup_failure,backup_size,execution_time,message) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+	rs, err := b.dbLogTx.Exec("insert into bak_summary(date,job,src_dir,dst_dir,state,storage,total_size,total_count,backup_modified,backup_added,backup_deleted,backup_moved,backup_success,backup_failure,backup_size,excluded,execution_time,message) values(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
 		b.S.Date.Format(time.RFC3339),
+		b.S.Job,
 		b.S.SrcDir,
 		b.S.DstDir,
 		b.S.State,
+		b.S.Storage,
 		b.S.TotalSize,
 		b.S.TotalCount,
 		b.S.BackupModified,
 		b.S.BackupAdded,
 		b.S.BackupDeleted,
+		b.S.BackupMoved,
 		b.S.BackupSuccess,
 		b.S.BackupFailure,
 		b.S.BackupSize,
+		b.S.Excluded,
 		b.S.ExecutionTime,
 		b.S.Message,
 	)
@@ -420,133 +1297,205 @@ func (b *Backup) writeToDatabase(newMap sync.Map, originMap sync.Map) error {
 		return err
 	}
 
-	b.S.ID, _ = rs.LastInsertId()
+	b.S.ID, err = rs.LastInsertId()
+	if err != nil {
+		return err
+	}
 	log.Infof("backup_id=%d", b.S.ID)
 
-	var maxInsertSize uint32 = 500
-	var lines []string
-	var eventLines []string
-	var i uint32 = 0
-	var j uint32 = 0
+	// Delete original data of the source
+	_, err = b.dbOriginTx.Exec("delete from bak_origin where job = ? and src_dir = ?", b.S.Job, b.srcDir)
+	if err != nil {
+		return err
+	}
 
-	// Delete original data
-	b.dbOriginTx.Exec("delete from bak_origin")
+	// Directories
+	if err := b.insertIntoDir(); err != nil {
+		return err
+	}
+
+	// Chunk manifests
+	var chunkStmt *sql.Stmt
+	if b.chunks != nil {
+		chunkStmt, err = b.dbLogTx.Prepare("insert into bak_chunk(id, path, seq, hash, size) values(?, ?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer chunkStmt.Close()
+	}
+
+	origin, err := newBatchInsert(b.dbOriginTx, "bak_origin", originColumns, b.Options.BatchSize)
+	if err != nil {
+		return err
+	}
+	events, err := newBatchInsert(b.dbLogTx, "bak_log", logColumns, b.Options.BatchSize)
+	if err != nil {
+		return err
+	}
 
 	// Modified or added files
 	newMap.Range(func(key, value interface{}) bool {
 		f := value.(*File)
-		path := strings.Replace(f.Path, "'", "''", -1)
-		lines = append(lines, fmt.Sprintf("select '%s', %d, '%s'", path, f.Size, f.ModTime.Format(time.RFC3339)))
-
-		i += 1
 
-		if i%maxInsertSize == 0 || i == b.S.TotalCount {
-			err := b.insertIntoOrigin(lines)
-			checkErr(err)
-			lines = nil
+		// A failed copy keeps the last baseline data, so that the next backup tries again
+		o := f
+		if f.State < 0 {
+			o = f.last
+		}
+		if o != nil {
+			if err = b.insertIntoOrigin(origin, o); err != nil {
+				return false
+			}
 		}
-
 		if f.State != 0 {
-			eventLines = append(eventLines, fmt.Sprintf("select %d, '%s', %d, '%s', %d, '%s'", b.S.ID, path, f.Size, f.ModTime.Format(time.RFC3339), f.State, f.Message))
-			j += 1
-
-			if j%maxInsertSize == 0 {
-				err := b.insertIntoLog(eventLines)
-				checkErr(err)
-				eventLines = nil
+			if err = b.insertIntoLog(events, f); err != nil {
+				return false
+			}
+		}
+		if f.State > 0 && chunkStmt != nil {
+			if err = b.insertIntoChunk(chunkStmt, f); err != nil {
+				return false
 			}
 		}
 		return true
 	})
-	if len(eventLines) > 0 {
-		err := b.insertIntoLog(eventLines)
-		checkErr(err)
-		eventLines = nil
+	if err != nil {
+		return err
+	}
+	if err := origin.close(); err != nil {
+		return err
+	}
+
+	// Paths which could not be read
+	for _, f := range b.failed {
+		if err := b.insertIntoLog(events, f); err != nil {
+			return err
+		}
 	}
 
 	// Deleted files
-	eventLines = make([]string, 0)
-	j = 0
+	var deleted uint32
 	originMap.Range(func(key, value interface{}) bool {
 		atomic.AddUint32(&b.S.BackupSuccess, 1)
 		f := value.(*File)
 		log.Debugf("deleted: %s", f.Path)
 		f.State = FileDeleted
-		path := strings.Replace(f.Path, "'", "''", -1)
-		eventLines = append(eventLines, fmt.Sprintf("select %d, '%s', %d, '%s', %d, '%s'", b.S.ID, path, f.Size, f.ModTime.Format(time.RFC3339), f.State, f.Message))
-		j += 1
-
-		if j%maxInsertSize == 0 {
-			err := b.insertIntoLog(eventLines)
-			checkErr(err)
-			eventLines = nil
+		if err = b.insertIntoLog(events, f); err != nil {
+			return false
 		}
+		deleted++
 		return true
 	})
-	if len(eventLines) > 0 {
-		err := b.insertIntoLog(eventLines)
-		checkErr(err)
-		eventLines = nil
+	if err != nil {
+		return err
 	}
-	atomic.AddUint32(&b.S.BackupDeleted, j)
+	if err := events.close(); err != nil {
+		return err
+	}
+	atomic.AddUint32(&b.S.BackupDeleted, deleted)
 
 	return nil
 }
 
-func (b *Backup) insertIntoLog(rows []string) error {
-	query := fmt.Sprintf("insert into bak_log(id, path, size, mtime, state, message) %s", strings.Join(rows, " union all "))
-	_, err := b.dbLogTx.Exec(query)
-	return err
+var logColumns = []string{"id", "path", "size", "mtime", "state", "message", "hash", "codec", "encrypted", "member", "member_offset", "mode", "uid", "gid", "link", "xattrs", "old_path"}
+
+// insertIntoLog writes the event of a file
+func (b *Backup) insertIntoLog(events *batchInsert, f *File) error {
+	return events.add(b.S.ID, f.Path, f.Size, f.ModTime.Format(time.RFC3339), f.State, f.Message, f.Hash, f.Codec, f.Encrypted, f.Member, f.Offset, f.Mode, f.Uid, f.Gid, f.Link, encodeXattrs(f.Xattrs), f.OldPath)
 }
 
-func (b *Backup) insertIntoOrigin(rows []string) error {
-	query := fmt.Sprintf("insert into bak_origin(path, size, mtime) %s", strings.Join(rows, " union all "))
-	_, err := b.dbOriginTx.Exec(query)
-	defer func() {
-		if r := recover(); r != nil {
-			if err != nil {
-				log.Println(query)
-			}
+// insertIntoDir writes the metadata of the directories of the source
+func (b *Backup) insertIntoDir() error {
+	stmt, err := b.dbLogTx.Prepare("insert into bak_dir(id, path, mode, uid, gid, mtime, xattrs) values(?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, d := range b.dirs {
+		_, err := stmt.Exec(b.S.ID, d.Path, d.Mode, d.Uid, d.Gid, d.ModTime.Format(time.RFC3339), encodeXattrs(d.Xattrs))
+		if err != nil {
+			return err
 		}
-	}()
-	checkErr(err)
-	return err
+	}
+	return nil
+}
+
+// insertIntoChunk writes the chunk manifest of a file
+func (b *Backup) insertIntoChunk(stmt *sql.Stmt, f *File) error {
+	for i, c := range f.Chunks {
+		_, err := stmt.Exec(b.S.ID, f.Path, i, c.Hash, c.Size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var originColumns = []string{"path", "size", "mtime", "hash", "job", "src_dir", "mode", "uid", "gid", "link", "xattr_hash"}
+
+// insertIntoOrigin writes the baseline data of a file
+func (b *Backup) insertIntoOrigin(origin *batchInsert, f *File) error {
+	return origin.add(f.Path, f.Size, f.ModTime.Format(time.RFC3339), f.Hash, b.S.Job, b.srcDir, f.Mode, f.Uid, f.Gid, f.Link, f.XattrHash)
 }
 
 func (b *Backup) Close() error {
+	if b.Options.DryRun {
+		return b.closeDryRun()
+	}
+
 	b.S.ExecutionTime = b.S.LoggingTime.Sub(b.S.Date).Seconds()
 	b.S.Message += fmt.Sprintf("reading: %3.1fs, comparing: %3.1fs, writing: %3.1fs",
 		b.S.ReadingTime.Sub(b.S.Date).Seconds(),
 		b.S.ComparisonTime.Sub(b.S.ReadingTime).Seconds(),
 		b.S.LoggingTime.Sub(b.S.ComparisonTime).Seconds(),
 	)
-	b.dbLogTx.Exec("update bak_summary set backup_deleted = ?, execution_time = ?, message = ? where id = ?",
-		b.S.BackupDeleted,
-		b.S.ExecutionTime,
-		b.S.Message,
-		b.S.ID,
-	)
-
-	b.dbLogTx.Commit()
-	b.dbOriginTx.Commit()
+	err := b.commit()
+	if err != nil {
+		log.Error(err)
+	}
 	b.dbOrigin.Close()
 	b.dbLog.Close()
+	// The temporary files of puts are gone by now; so goes their directory
+	if err := b.storage.Delete(putTempDir); err != nil {
+		log.Error(err)
+	}
+	if err := b.storage.Close(); err != nil {
+		log.Error(err)
+	}
+	if err := b.journal.remove(); err != nil {
+		log.Error(err)
+	}
+	if err := b.lock.release(); err != nil {
+		log.Error(err)
+	}
 
-	if b.S.ID > 1 { // ID 1 is about initializing data
+	if b.S.State != StateFailed {
 		log.WithFields(log.Fields{
 			"modified": b.S.BackupModified,
 			"added":    b.S.BackupAdded,
 			"deleted":  b.S.BackupDeleted,
-		}).Infof("files: %d", b.S.BackupModified+b.S.BackupAdded+b.S.BackupDeleted)
+			"moved":    b.S.BackupMoved,
+		}).Infof("files: %d", b.S.BackupModified+b.S.BackupAdded+b.S.BackupDeleted+b.S.BackupMoved)
 		log.WithFields(log.Fields{
 			"success": b.S.BackupSuccess,
 			"failure": b.S.BackupFailure,
 		}).Infof("backup result")
 		log.Infof("backup size: %d(%s)", b.S.BackupSize, humanize.Bytes(b.S.BackupSize))
+		if b.unchangedCopied > 0 {
+			log.Infof("unchanged files copied into the snapshot: %d", b.unchangedCopied)
+		}
+		if b.chunks != nil {
+			log.WithFields(log.Fields{
+				"chunks": b.chunks.NewChunks,
+				"size":   fmt.Sprintf("%d(%s)", b.chunks.NewSize, humanize.Bytes(b.chunks.NewSize)),
+			}).Info("new data in chunk store")
+		}
 	}
 	log.WithFields(log.Fields{
-		"files": b.S.TotalCount,
-		"size":  fmt.Sprintf("%d(%s)", b.S.TotalSize, humanize.Bytes(b.S.TotalSize)),
+		"files":    b.S.TotalCount,
+		"size":     fmt.Sprintf("%d(%s)", b.S.TotalSize, humanize.Bytes(b.S.TotalSize)),
+		"excluded": b.S.Excluded,
 	}).Info("source directory")
 
 	log.WithFields(log.Fields{
@@ -555,10 +1504,175 @@ func (b *Backup) Close() error {
 		"writing":    fmt.Sprintf("%3.1fs", b.S.LoggingTime.Sub(b.S.ComparisonTime).Seconds()),
 	}).Infof("execution time: %3.1fs", b.S.ExecutionTime)
 
+	return err
+}
+
+// commit writes the databases of the run; those of a failed run are rolled back.
+// The log is committed first: if the baseline is then not written, the next backup
+// only copies the changes again.
+func (b *Backup) commit() error {
+	if b.S.State == StateFailed {
+		b.dbLogTx.Rollback()
+		b.dbOriginTx.Rollback()
+		return nil
+	}
+
+	_, err := b.dbLogTx.Exec("update bak_summary set backup_deleted = ?, execution_time = ?, message = ? where id = ?",
+		b.S.BackupDeleted,
+		b.S.ExecutionTime,
+		b.S.Message,
+		b.S.ID,
+	)
+	if err == nil {
+		err = b.dbLogTx.Commit()
+	}
+	if err != nil {
+		b.dbLogTx.Rollback()
+		b.dbOriginTx.Rollback()
+		if b.S.DstDir != "" {
+			b.discard()
+		}
+		b.S.State = StateFailed
+		b.S.Message = err.Error()
+		return err
+	}
+	return b.dbOriginTx.Commit()
+}
+
+func (b *Backup) closeDryRun() error {
+	if b.dbOrigin != nil {
+		b.dbOrigin.Close()
+		b.dbLog.Close()
+	}
+	b.S.ExecutionTime = b.S.LoggingTime.Sub(b.S.Date).Seconds()
+
+	log.WithFields(log.Fields{
+		"modified": b.S.BackupModified,
+		"added":    b.S.BackupAdded,
+		"deleted":  b.S.BackupDeleted,
+		"moved":    b.S.BackupMoved,
+	}).Infof("files: %d", b.S.BackupModified+b.S.BackupAdded+b.S.BackupDeleted+b.S.BackupMoved)
+	log.Infof("projected backup size: %d(%s)", b.S.BackupSize, humanize.Bytes(b.S.BackupSize))
+	log.WithFields(log.Fields{
+		"files":    b.S.TotalCount,
+		"size":     fmt.Sprintf("%d(%s)", b.S.TotalSize, humanize.Bytes(b.S.TotalSize)),
+		"excluded": b.S.Excluded,
+	}).Info("source directory")
 	return nil
 }
 
-func (b *Backup) BackupFile(path string) (string, float64, error) {
+// store copies the file into the backup directory or into the chunk store
+func (b *Backup) store(fi *File) (float64, error) {
+	if b.Options.DryRun {
+		return 0, nil
+	}
+
+	// Symlinks are recorded in the catalog only, except in snapshots
+	if fi.Mode&os.ModeSymlink != 0 {
+		if b.snapshot != nil {
+			return 0, b.snapshot.symlink(fi.Link, b.copyName(fi.Path))
+		}
+		return 0, nil
+	}
+
+	// Archives cannot be resumed, so nothing is journaled
+	if b.archive != nil {
+		t := time.Now()
+		var err error
+		fi.Member, fi.Offset, err = b.archive.add(fi, b.srcDir)
+		return time.Since(t).Seconds(), err
+	}
+
+	if b.resumeCopy(fi) {
+		return 0, nil
+	}
+
+	var dur float64
+	var err error
+	if b.chunks != nil {
+		fi.Chunks, dur, err = b.BackupChunks(fi.Path)
+	} else {
+		fi.Codec = b.Options.codecFor(fi.Path)
+		fi.Encrypted = b.key != nil
+		_, dur, err = b.BackupFile(fi.Path, fi.Codec, fi.ModTime)
+	}
+	if err != nil {
+		return dur, err
+	}
+
+	if err := b.journal.add(fi); err != nil {
+		log.Error(err)
+	}
+	return dur, nil
+}
+
+// resumeCopy reuses the copy made by the interrupted backup being resumed if the file has not changed since
+func (b *Backup) resumeCopy(fi *File) bool {
+	if b.copied == nil {
+		return false
+	}
+	v, ok := b.copied.LoadAndDelete(fi.Path)
+	if !ok {
+		return false
+	}
+	e := v.(*journalEntry)
+	if e.Size != fi.Size || !e.ModTime.Equal(fi.ModTime) || (e.Hash != "" && fi.Hash != "" && e.Hash != fi.Hash) {
+		return false
+	}
+	if b.chunks == nil {
+		copied, err := b.storage.Stat(b.copyName(fi.Path))
+		if err != nil || (e.Codec == CodecNone && !e.Encrypted && copied.Size != fi.Size) {
+			return false
+		}
+	}
+
+	log.Debugf("copied by the interrupted backup: %s", fi.Path)
+	fi.Chunks = e.Chunks
+	fi.Codec = e.Codec
+	fi.Encrypted = e.Encrypted
+	if fi.Hash == "" {
+		fi.Hash = e.Hash
+	}
+	return true
+}
+
+// removeUnusedCopies deletes the copies made by the interrupted backup being resumed
+// of files which have been deleted or restored to their last backed up state since
+func (b *Backup) removeUnusedCopies() {
+	if b.copied == nil || b.chunks != nil {
+		return
+	}
+
+	b.copied.Range(func(key, value interface{}) bool {
+		name := b.copyName(key.(string))
+		log.Debugf("removing unused copy: %s", name)
+		if err := b.storage.Delete(name); err != nil {
+			log.Error(err)
+		}
+		return true
+	})
+}
+
+func (b *Backup) BackupChunks(path string) ([]Chunk, float64, error) {
+	t := time.Now()
+	from, err := os.Open(path)
+	if err != nil {
+		return nil, time.Since(t).Seconds(), err
+	}
+	defer from.Close()
+
+	chunks, err := b.chunks.Put(from)
+	return chunks, time.Since(t).Seconds(), err
+}
+
+// copyName returns the storage name of the copy of a file made by this backup
+func (b *Backup) copyName(path string) string {
+	return copyName(filepath.Base(b.tempDir), b.srcDir, path)
+}
+
+// BackupFile copies a file into the backup storage, compressed with codec and encrypted if the destination is.
+// It returns the storage name of the copy.
+func (b *Backup) BackupFile(path, codec string, modTime time.Time) (string, float64, error) {
 	// Set source
 	t := time.Now()
 	from, err := os.Open(path)
@@ -569,25 +1683,39 @@ func (b *Backup) BackupFile(path string) (string, float64, error) {
 	defer from.Close()
 
 	// Set destination
-	dst := filepath.Join(b.tempDir, path[len(b.srcDir):])
-	err = os.MkdirAll(filepath.Dir(dst), 0644)
-	to, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		return "", time.Since(t).Seconds(), err
+	name := b.copyName(path)
+	to := putWriter(b.storage, name, modTime)
+
+	// Copy; data is compressed before it is encrypted
+	var w io.Writer = to
+	var closers []io.Closer
+	if b.key != nil {
+		enc, err := newEncrypter(w, b.key)
+		if err != nil {
+			to.abort(err)
+			return "", time.Since(t).Seconds(), err
+		}
+		w = enc
+		closers = append(closers, enc)
 	}
-	defer to.Close()
-
-	// Copy
-	_, err = io.Copy(to, from)
-	if err != nil {
-		return "", time.Since(t).Seconds(), err
+	if codec != CodecNone {
+		zw, err := newCompressor(w, codec, b.Options.CompressionLevel)
+		if err != nil {
+			to.abort(err)
+			return "", time.Since(t).Seconds(), err
+		}
+		w = zw
+		closers = append([]io.Closer{zw}, closers...)
+	}
+	_, err = io.Copy(w, from)
+	for _, c := range closers {
+		if err == nil {
+			err = c.Close()
+		}
 	}
-
-	return dst, time.Since(t).Seconds(), err
-}
-
-func checkErr(err error) {
 	if err != nil {
-		log.Errorf("[Error] %s", err.Error())
+		to.abort(err)
+		return "", time.Since(t).Seconds(), err
 	}
+	return name, time.Since(t).Seconds(), to.Close()
 }
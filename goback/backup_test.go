@@ -0,0 +1,253 @@
+package goback
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*Options)
+		valid bool
+	}{
+		{"default", func(o *Options) {}, true},
+		{"zstd", func(o *Options) { o.Compression = CodecZstd }, true},
+		{"dedup and compression", func(o *Options) { o.Dedup, o.Compression = true, CodecGzip }, false},
+		{"archive and dedup", func(o *Options) { o.Archive, o.Dedup = StorageZip, true }, false},
+		{"snapshot and archive", func(o *Options) { o.Snapshot, o.Archive = true, StorageTarZst }, false},
+		{"encryption", func(o *Options) { o.Passphrase = "secret" }, true},
+		{"encryption and dedup", func(o *Options) { o.Passphrase, o.Dedup = "secret", true }, false},
+		{"encryption and archive", func(o *Options) { o.Passphrase, o.Archive = "secret", StorageZip }, false},
+		{"encryption and snapshot", func(o *Options) { o.Passphrase, o.Snapshot = "secret", true }, false},
+		{"batch size", func(o *Options) { o.BatchSize = -1 }, false},
+		{"storage", func(o *Options) { o.StorageURL = "ftp://host/dir" }, false},
+		{"exclude", func(o *Options) { o.Excludes = []string{"/"} }, false},
+	}
+	for _, tt := range tests {
+		o := defaultOptions()
+		tt.setup(&o)
+		if err := o.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// A file rewritten with its size and mtime kept is taken as modified only when checksums are compared
+func TestChecksumCompare(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	rewrite := func(data string) {
+		writeFiles(t, srcDir, map[string]string{"a.txt": data})
+		if err := os.Chtimes(filepath.Join(srcDir, "a.txt"), modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checksum := func(o *Options) { o.Checksum = true }
+
+	rewrite("first")
+	writeFiles(t, srcDir, map[string]string{"b.txt": "unchanged"})
+	if _, err := runBackup(t, srcDir, dstDir, checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	rewrite("other")
+	s, err := runBackup(t, srcDir, dstDir, checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupModified != 1 {
+		t.Fatalf("%d files modified", s.BackupModified)
+	}
+	versions := loggedVersions(t, dstDir, s.ID)
+	if len(versions) != 1 || versions[0].Hash == "" {
+		t.Fatalf("logged %v", versions)
+	}
+	if got := restoreTree(t, dstDir, s.ID); got["a.txt"] != "other" {
+		t.Errorf("restored %v", got)
+	}
+
+	rewrite("third")
+	s, err = runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupModified != 0 {
+		t.Errorf("%d files modified without checksums", s.BackupModified)
+	}
+}
+
+// A file whose checksum cannot be computed fails and keeps its baseline
+func TestChecksumUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root reads anything")
+	}
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a", "b.txt": "b"})
+	checksum := func(o *Options) { o.Checksum = true }
+	if _, err := runBackup(t, srcDir, dstDir, checksum); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, srcDir, map[string]string{"c.txt": "c"})
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if err := os.Chmod(filepath.Join(srcDir, name), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := runBackup(t, srcDir, dstDir, checksum)
+	if !IsPartial(err) {
+		t.Fatalf("backup not partial: %v", err)
+	}
+	if s.BackupFailure != 2 || s.BackupDeleted > 0 {
+		t.Errorf("%d failed, %d deleted", s.BackupFailure, s.BackupDeleted)
+	}
+	want := map[string]int{"a.txt": -FileModified, "c.txt": -FileAdded}
+	for _, v := range loggedVersions(t, dstDir, s.ID) {
+		if rel := filepath.Base(v.Path); v.State != want[rel] {
+			t.Errorf("%s: logged %d, want %d", rel, v.State, want[rel])
+		}
+	}
+
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if err := os.Chmod(filepath.Join(srcDir, name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = runBackup(t, srcDir, dstDir, checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupModified != 0 || s.BackupAdded != 1 {
+		t.Errorf("%d modified, %d added", s.BackupModified, s.BackupAdded)
+	}
+}
+
+// Every file is compared and stored once whatever the number of workers, and a chunk
+// stored by several workers at once is counted once
+func TestWorkers(t *testing.T) {
+	for _, workers := range []int{0, 1, 8} {
+		srcDir, dstDir := t.TempDir(), t.TempDir()
+		files := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			files[fmt.Sprintf("dir%d/file%d.txt", i%7, i)] = fmt.Sprintf("content %d", i%10)
+		}
+		writeFiles(t, srcDir, files)
+
+		setup := func(o *Options) { o.Workers, o.Dedup = workers, true }
+		b := newTestBackup(t, srcDir, dstDir, setup)
+		s, err := finishBackup(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.TotalCount != 100 || s.BackupAdded != 100 || s.BackupSuccess != 100 || b.chunks.NewChunks != 10 {
+			t.Errorf("%d workers: %d files, %d added, %d stored, %d chunks", workers, s.TotalCount, s.BackupAdded, s.BackupSuccess, b.chunks.NewChunks)
+		}
+		if got := restoreTree(t, dstDir, s.ID); !reflect.DeepEqual(got, files) {
+			t.Errorf("%d workers: %d files restored", workers, len(got))
+		}
+
+		changed := make(map[string]string)
+		for i := 0; i < 100; i += 2 {
+			changed[fmt.Sprintf("dir%d/file%d.txt", i%7, i)] = fmt.Sprintf("changed content %d", i)
+		}
+		writeFiles(t, srcDir, changed)
+		for name, data := range changed {
+			files[name] = data
+		}
+		s, err = runBackup(t, srcDir, dstDir, setup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.BackupModified != 50 {
+			t.Errorf("%d workers: %d modified", workers, s.BackupModified)
+		}
+		if got := restoreTree(t, dstDir, s.ID); !reflect.DeepEqual(got, files) {
+			t.Errorf("%d workers: %d files restored after changes", workers, len(got))
+		}
+	}
+}
+
+// A dry run reports the changes of a backup without writing to the destination
+func TestDryRun(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a", "b.txt": "b"})
+	dryRun := func(o *Options) { o.DryRun = true }
+	changes := func(s *Summary) map[string]int {
+		states := make(map[string]int)
+		for _, f := range s.Changes {
+			rel, _ := filepath.Rel(srcDir, f.Path)
+			states[filepath.ToSlash(rel)] = f.State
+		}
+		return states
+	}
+	// The paths under the destination with the content of its files
+	destination := func() map[string]string {
+		entries := readTree(t, dstDir)
+		err := filepath.Walk(dstDir, func(path string, f os.FileInfo, err error) error {
+			if err == nil && f.IsDir() {
+				entries[path] = "dir"
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	before := destination()
+	s, err := runBackup(t, srcDir, dstDir, dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a.txt": FileAdded, "b.txt": FileAdded}; !reflect.DeepEqual(changes(s), want) {
+		t.Errorf("first backup: changes %v, want %v", changes(s), want)
+	}
+	if s.BackupAdded != 2 || s.BackupSize != 2 {
+		t.Errorf("first backup: %d added, %d bytes", s.BackupAdded, s.BackupSize)
+	}
+	if after := destination(); !reflect.DeepEqual(after, before) {
+		t.Errorf("destination written: %v", after)
+	}
+
+	if _, err := runBackup(t, srcDir, dstDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, srcDir, map[string]string{"a.txt": "changed", "c.txt": "new file"})
+	if err := os.Remove(filepath.Join(srcDir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	before = destination()
+	s, err = runBackup(t, srcDir, dstDir, dryRun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"a.txt": FileModified, "b.txt": FileDeleted, "c.txt": FileAdded}; !reflect.DeepEqual(changes(s), want) {
+		t.Errorf("changes %v, want %v", changes(s), want)
+	}
+	if after := destination(); !reflect.DeepEqual(after, before) {
+		t.Errorf("destination written: %v", after)
+	}
+	if n := countSummaries(t, dstDir); n != 1 {
+		t.Errorf("%d backups in the catalog", n)
+	}
+}
+
+// The directory of temporary files of puts is gone when a backup is done
+func TestPutTempDirRemoved(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a", "dir/b.txt": "b"})
+	for _, setup := range []func(*Options){nil, func(o *Options) { o.Dedup = true }} {
+		if _, err := runBackup(t, srcDir, dstDir, setup); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(dstDir, putTempDir)); !os.IsNotExist(err) {
+			t.Errorf("%s left: %v", putTempDir, err)
+		}
+	}
+}
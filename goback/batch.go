@@ -0,0 +1,82 @@
+package goback
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultBatchSize = 500  // Rows per insert statement unless set by the options
+	maxBatchSize     = 1000 // Keeps the parameters of a statement below the limit of SQLite
+)
+
+func checkBatchSize(size int) error {
+	if size < 1 || size > maxBatchSize {
+		return fmt.Errorf("invalid batch size: %d (1-%d)", size, maxBatchSize)
+	}
+	return nil
+}
+
+// batchInsert inserts rows into a table within a transaction, size rows per statement.
+// Values are bound as parameters, so paths with any bytes are stored as they are.
+type batchInsert struct {
+	tx      *sql.Tx
+	table   string
+	columns []string
+	size    int
+	stmt    *sql.Stmt // Inserts a full batch
+	args    []interface{}
+}
+
+func newBatchInsert(tx *sql.Tx, table string, columns []string, size int) (*batchInsert, error) {
+	bi := &batchInsert{
+		tx:      tx,
+		table:   table,
+		columns: columns,
+		size:    size,
+		args:    make([]interface{}, 0, size*len(columns)),
+	}
+	var err error
+	bi.stmt, err = tx.Prepare(bi.query(size))
+	if err != nil {
+		return nil, err
+	}
+	return bi, nil
+}
+
+// query returns the insert statement of n rows
+func (bi *batchInsert) query(n int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(bi.columns)), ", ") + ")"
+	rows := make([]string, n)
+	for i := range rows {
+		rows[i] = row
+	}
+	return fmt.Sprintf("insert into %s(%s) values %s", bi.table, strings.Join(bi.columns, ", "), strings.Join(rows, ", "))
+}
+
+// add adds a row; the batch is written when it is full
+func (bi *batchInsert) add(values ...interface{}) error {
+	if len(values) != len(bi.columns) {
+		return fmt.Errorf("%s: %d values for %d columns", bi.table, len(values), len(bi.columns))
+	}
+	bi.args = append(bi.args, values...)
+	if len(bi.args) < cap(bi.args) {
+		return nil
+	}
+	_, err := bi.stmt.Exec(bi.args...)
+	bi.args = bi.args[:0]
+	return err
+}
+
+// close writes the remaining rows and releases the statement
+func (bi *batchInsert) close() error {
+	defer bi.stmt.Close()
+	n := len(bi.args) / len(bi.columns)
+	if n < 1 {
+		return nil
+	}
+	_, err := bi.tx.Exec(bi.query(n), bi.args...)
+	bi.args = bi.args[:0]
+	return err
+}
@@ -0,0 +1,99 @@
+package goback
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Rows are written when a batch is full and the rest on close, with values as they are
+func TestBatchInsert(t *testing.T) {
+	const size = 3
+	for _, n := range []int{0, 1, size - 1, size, size + 1, 2 * size, 2*size + 1} {
+		db, err := sql.Open("sqlite3", ":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		if _, err := db.Exec("create table t(id integer, path text)"); err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := func() int {
+			var count int
+			if err := tx.QueryRow("select count(*) from t").Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+
+		bi, err := newBatchInsert(tx, "t", []string{"id", "path"}, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			if err := bi.add(i, fmt.Sprintf("it's \"%d\", (?)", i)); err != nil {
+				t.Fatal(err)
+			}
+			if written := count(); written != (i+1)/size*size {
+				t.Errorf("%d rows: %d written after row %d", n, written, i)
+			}
+		}
+		if err := bi.add(n); err == nil {
+			t.Errorf("%d rows: row with missing values added", n)
+		}
+		if err := bi.close(); err != nil {
+			t.Fatal(err)
+		}
+		if written := count(); written != n {
+			t.Errorf("%d rows: %d written on close", n, written)
+		}
+
+		rows, err := tx.Query("select id, path from t order by rowid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; rows.Next(); i++ {
+			var id int
+			var path string
+			if err := rows.Scan(&id, &path); err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("it's \"%d\", (?)", i); id != i || path != want {
+				t.Errorf("%d rows: row %d is %d %q", n, i, id, path)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+		tx.Rollback()
+		db.Close()
+	}
+}
+
+// A backup logs every file whatever the batch size
+func TestBatchSize(t *testing.T) {
+	for _, size := range []int{1, 2, maxBatchSize} {
+		srcDir, dstDir := t.TempDir(), t.TempDir()
+		files := make(map[string]string)
+		for i := 0; i < 5; i++ {
+			files[fmt.Sprintf("file%d.txt", i)] = fmt.Sprintf("%d", i)
+		}
+		writeFiles(t, srcDir, files)
+		s, err := runBackup(t, srcDir, dstDir, func(o *Options) { o.BatchSize = size })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if logged := loggedVersions(t, dstDir, s.ID); len(logged) != len(files) {
+			t.Errorf("batch size %d: %d files logged", size, len(logged))
+		}
+		if got := restoreTree(t, dstDir, s.ID); !reflect.DeepEqual(got, files) {
+			t.Errorf("batch size %d: restored %v", size, got)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package goback
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Version struct {
+	ID        int64
+	Date      time.Time
+	Job       string
+	SrcDir    string
+	DstDir    string
+	Storage   string
+	Path      string
+	Size      int64
+	ModTime   time.Time
+	State     int
+	Message   string
+	Hash      string
+	Codec     string
+	Encrypted bool
+	Member    string // Archive member name
+	Offset    int64  // Offset of the member in a tar.zst archive
+
+	Mode   os.FileMode
+	Uid    int
+	Gid    int
+	Link   string // Target of a symlink; nothing is stored for symlinks
+	Xattrs map[string][]byte
+
+	OldPath string // Path a moved file was moved from; its data is stored there
+	Pruned  bool   // The backup was pruned; the copy is kept only if a later backup needs it
+}
+
+// storageName returns the storage name of the copy stored by the backup.
+// Copies in an archive share the name of the archive.
+func (v *Version) storageName() string {
+	if isArchive(v.Storage) {
+		return filepath.Base(v.DstDir)
+	}
+	return copyName(filepath.Base(v.DstDir), v.SrcDir, v.Path)
+}
+
+// catalog reads the log database and the stored data of a backup directory
+type catalog struct {
+	dstDir    string
+	dbLogFile string
+
+	db      *sql.DB
+	storage Storage
+	chunks  *chunkStore
+	key     []byte
+	zips    zipArchives
+}
+
+func newCatalog(dstDir string) *catalog {
+	return &catalog{
+		dstDir:    filepath.Clean(dstDir),
+		dbLogFile: filepath.Join(filepath.Clean(dstDir), "backup_log.db"),
+	}
+}
+
+func (c *catalog) open() error {
+	if _, err := os.Stat(c.dbLogFile); err != nil {
+		return err
+	}
+
+	var err error
+	c.db, err = sql.Open("sqlite3", c.dbLogFile)
+	if err != nil {
+		return err
+	}
+	if err := initLogDB(c.db); err != nil {
+		return err
+	}
+
+	location, err := getMeta(c.db, metaStorageURL)
+	if err != nil {
+		return err
+	}
+	c.storage, err = OpenStorage(location, c.dstDir)
+	if err != nil {
+		return err
+	}
+	c.chunks = newChunkStore(c.storage)
+	return nil
+}
+
+// unlock loads the key of an encrypted backup directory
+func (c *catalog) unlock(passphrase string) error {
+	var err error
+	c.key, err = loadKey(c.dstDir, passphrase)
+	return err
+}
+
+func (c *catalog) close() error {
+	c.zips.close()
+	if c.storage != nil {
+		c.storage.Close()
+	}
+	if c.db != nil {
+		return c.db.Close()
+	}
+	return nil
+}
+
+func (c *catalog) getSummary(backupID int64) (*Summary, error) {
+	var date string
+	s := newSummary(0, "")
+	err := c.db.QueryRow("select id, date, job, src_dir, dst_dir, state, pruned, message from bak_summary where id = ?", backupID).
+		Scan(&s.ID, &date, &s.Job, &s.SrcDir, &s.DstDir, &s.State, &s.Pruned, &s.Message)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("backup not found: %d", backupID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Date, _ = time.Parse(time.RFC3339, date)
+	return s, nil
+}
+
+func (c *catalog) queryVersions(where string, args ...interface{}) ([]*Version, error) {
+	rows, err := c.db.Query(`
+		select t1.id, t2.date, t2.job, t2.src_dir, t2.dst_dir, t2.storage, t1.path, t1.size, t1.mtime, t1.state, t1.message, t1.hash, t1.codec, t1.encrypted, t1.member, t1.member_offset, t1.mode, t1.uid, t1.gid, t1.link, t1.xattrs, t1.old_path, t2.pruned
+		from bak_log t1 join bak_summary t2 on t2.id = t1.id
+		where `+where+`
+		order by t1.id desc, t1.path asc
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*Version
+	for rows.Next() {
+		var date, modTime, xattrs string
+		v := &Version{}
+		if err := rows.Scan(&v.ID, &date, &v.Job, &v.SrcDir, &v.DstDir, &v.Storage, &v.Path, &v.Size, &modTime, &v.State, &v.Message, &v.Hash, &v.Codec, &v.Encrypted, &v.Member, &v.Offset, &v.Mode, &v.Uid, &v.Gid, &v.Link, &xattrs, &v.OldPath, &v.Pruned); err != nil {
+			return nil, err
+		}
+		v.Xattrs = decodeXattrs(xattrs)
+		v.Date, _ = time.Parse(time.RFC3339, date)
+		v.ModTime, _ = time.Parse(time.RFC3339, modTime)
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// targetVersions returns the versions of a source a restore of backupID needs, newest first:
+// the newest version of every path at or before the backup which did not fail, the failed
+// versions after it, and the newest move away from every path.
+func (c *catalog) targetVersions(backupID int64, job, srcDir string) ([]*Version, error) {
+	return c.queryVersions(`t1.rowid in (
+			select t3.rowid from bak_log t3 join bak_summary t4 on t4.id = t3.id
+			left join (
+				select t5.path, max(t5.id) id from bak_log t5 join bak_summary t6 on t6.id = t5.id
+				where t5.id <= ? and t6.job = ? and t6.src_dir = ? and t5.state >= 0
+				group by t5.path
+			) t7 on t7.path = t3.path
+			where t3.id <= ? and t4.job = ? and t4.src_dir = ? and (t3.id = t7.id or (t3.state < 0 and (t7.id is null or t3.id > t7.id)))
+		) or t1.rowid in (
+			select moved from (
+				select t3.rowid moved, max(t3.id) from bak_log t3 join bak_summary t4 on t4.id = t3.id
+				where t3.id <= ? and t4.job = ? and t4.src_dir = ? and t3.state = ?
+				group by t3.old_path
+			)
+		)`,
+		backupID, job, srcDir, backupID, job, srcDir, backupID, job, srcDir, FileMoved)
+}
+
+// firstEvents returns the ID and state of the first version of every path of a source,
+// and the ID of the first move away from every path
+func (c *catalog) firstEvents(job, srcDir string) (map[string]*Version, map[string]int64, error) {
+	rows, err := c.db.Query(`
+		select t1.path, min(t1.id), t1.state from bak_log t1 join bak_summary t2 on t2.id = t1.id
+		where t2.job = ? and t2.src_dir = ?
+		group by t1.path
+	`, job, srcDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	first := make(map[string]*Version)
+	for rows.Next() {
+		v := &Version{}
+		if err := rows.Scan(&v.Path, &v.ID, &v.State); err != nil {
+			return nil, nil, err
+		}
+		first[v.Path] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	rows, err = c.db.Query(`
+		select t1.old_path, min(t1.id) from bak_log t1 join bak_summary t2 on t2.id = t1.id
+		where t2.job = ? and t2.src_dir = ? and t1.state = ?
+		group by t1.old_path
+	`, job, srcDir, FileMoved)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	movedAway := make(map[string]int64)
+	for rows.Next() {
+		var path string
+		var id int64
+		if err := rows.Scan(&path, &id); err != nil {
+			return nil, nil, err
+		}
+		movedAway[path] = id
+	}
+	return first, movedAway, rows.Err()
+}
+
+// getDirs returns the directories of a source recorded by its newest backup at or before backupID,
+// optionally only those at or under path
+func (c *catalog) getDirs(backupID int64, job, srcDir, path string) ([]*File, error) {
+	prefix := strings.TrimSuffix(path, string(os.PathSeparator)) + string(os.PathSeparator)
+	rows, err := c.db.Query(`
+		select path, mode, uid, gid, mtime, xattrs
+		from bak_dir
+		where id = (
+			select max(t1.id) from bak_dir t1 join bak_summary t2 on t2.id = t1.id
+			where t1.id <= ? and t2.job = ? and t2.src_dir = ?
+		) and (? = '' or path = ? or substr(cast(path as blob), 1, ?) = cast(? as blob))
+	`, backupID, job, srcDir, path, path, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dirs := make([]*File, 0)
+	for rows.Next() {
+		var modTime, xattrs string
+		d := &File{}
+		if err := rows.Scan(&d.Path, &d.Mode, &d.Uid, &d.Gid, &modTime, &xattrs); err != nil {
+			return nil, err
+		}
+		d.ModTime, _ = time.Parse(time.RFC3339, modTime)
+		d.Xattrs = decodeXattrs(xattrs)
+		dirs = append(dirs, d)
+	}
+	return dirs, rows.Err()
+}
+
+// originPaths returns the paths in the baseline of a source.
+// A backup directory without a baseline database has none.
+func (c *catalog) originPaths(job, srcDir string) ([]string, error) {
+	name := filepath.Join(c.dstDir, "backup_origin.db")
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return nil, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+name+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("select path from bak_origin where job = ? and src_dir = ?", job, srcDir)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// getLastAt returns the last successful backup of a source taken at or before the
+// given time and, if backupID is greater than zero, not newer than that backup
+func (c *catalog) getLastAt(job, srcDir string, at time.Time, backupID int64) (*Summary, error) {
+	rows, err := c.db.Query("select id, date from bak_summary where job = ? and src_dir = ? and state > 0 and (? < 1 or id <= ?) order by id desc",
+		job, srcDir, backupID, backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var date string
+		if err := rows.Scan(&id, &date); err != nil {
+			return nil, err
+		}
+		t, _ := time.Parse(time.RFC3339, date)
+		if !t.After(at) {
+			rows.Close()
+			return c.getSummary(id)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no backup of %s at or before %s", srcDir, at.Format(time.RFC3339))
+}
+
+// getSources returns the sources with a successful backup
+func (c *catalog) getSources() ([]*Summary, error) {
+	rows, err := c.db.Query("select distinct job, src_dir from bak_summary where state > 0 order by job, src_dir")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make([]*Summary, 0)
+	for rows.Next() {
+		s := newSummary(0, "")
+		if err := rows.Scan(&s.Job, &s.SrcDir); err != nil {
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	return sources, rows.Err()
+}
+
+// Open returns a reader of the backed up content of a version
+func (c *catalog) Open(v *Version) (io.ReadCloser, error) {
+	if v.Storage == StorageChunk {
+		chunks, err := c.getChunks(v)
+		if err != nil {
+			return nil, err
+		}
+		return c.chunks.Open(chunks), nil
+	}
+	switch v.Storage {
+	case StorageTarZst:
+		return openTarMember(c.storage, v.storageName(), v.Offset, v.Member)
+	case StorageZip:
+		return c.zips.member(c.storage, v.storageName(), v.Member)
+	}
+	if v.Encrypted && c.key == nil {
+		return nil, ErrPassphraseRequired
+	}
+	f, err := c.storage.Get(v.storageName(), 0)
+	if err != nil {
+		return nil, err
+	}
+	var r io.ReadCloser = f
+	if v.Encrypted {
+		r, err = newDecrypter(r, c.key)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	zr, err := newDecompressor(r, v.Codec)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return zr, nil
+}
+
+func (c *catalog) getChunks(v *Version) ([]Chunk, error) {
+	rows, err := c.db.Query("select hash, size from bak_chunk where id = ? and path = ? order by seq asc", v.ID, v.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chunks := make([]Chunk, 0)
+	var size int64
+	for rows.Next() {
+		var c Chunk
+		if err := rows.Scan(&c.Hash, &c.Size); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+		size += c.Size
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if size != v.Size {
+		return nil, fmt.Errorf("incomplete chunk manifest: %s", v.Path)
+	}
+	return chunks, nil
+}
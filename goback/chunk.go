@@ -0,0 +1,200 @@
+package goback
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Content-defined chunking parameters. Changing them or the gear table moves
+// chunk boundaries, so content stored before the change no longer deduplicates.
+const (
+	minChunkSize = 512 << 10
+	maxChunkSize = 8 << 20
+	chunkMask    = (1 << 20) - 1 // 1 MiB on average
+)
+
+var gearTable [256]uint64
+
+func init() {
+	// Fixed seed; see the chunking parameters above
+	var seed uint64 = 0x676f6261636b
+	for i := range gearTable {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+type Chunk struct {
+	Hash string
+	Size int64
+}
+
+// chunkStore keeps file contents as chunks named by their SHA-256 hash,
+// so identical content across paths and runs is stored once.
+type chunkStore struct {
+	storage Storage
+	written sync.Map
+
+	NewChunks uint32
+	NewSize   uint64
+}
+
+const chunkDir = "chunks"
+
+func newChunkStore(storage Storage) *chunkStore {
+	return &chunkStore{
+		storage: storage,
+	}
+}
+
+func (c *chunkStore) name(hash string) string {
+	return path.Join(chunkDir, hash[:2], hash)
+}
+
+// Put splits r into content-defined chunks, stores the ones that do not exist yet
+// and returns the manifest
+func (c *chunkStore) Put(r io.Reader) ([]Chunk, error) {
+	chunks := make([]Chunk, 0)
+	rd := bufio.NewReaderSize(r, 1<<20)
+	buf := make([]byte, 0, maxChunkSize)
+	for {
+		data, err := nextChunk(rd, buf)
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(data)
+		chunk := Chunk{
+			Hash: hex.EncodeToString(sum[:]),
+			Size: int64(len(data)),
+		}
+		if err := c.write(chunk.Hash, data); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+}
+
+func (c *chunkStore) write(hash string, data []byte) error {
+	name := c.name(hash)
+	if _, ok := c.written.Load(hash); ok {
+		return nil
+	}
+	if _, err := c.storage.Stat(name); err == nil {
+		return nil
+	}
+
+	if err := c.storage.Put(name, bytes.NewReader(data), time.Time{}); err != nil {
+		return err
+	}
+
+	// The same new chunk may be written by several workers at once; count it once
+	if _, loaded := c.written.LoadOrStore(hash, true); !loaded {
+		atomic.AddUint32(&c.NewChunks, 1)
+		atomic.AddUint64(&c.NewSize, uint64(len(data)))
+	}
+	return nil
+}
+
+// Open returns a reader of the content described by the manifest.
+// Every chunk is verified against its hash while reading.
+func (c *chunkStore) Open(chunks []Chunk) io.ReadCloser {
+	return &chunkReader{
+		store:  c,
+		chunks: chunks,
+	}
+}
+
+// nextChunk reads the next chunk into buf using a gear rolling hash
+func nextChunk(rd *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	var h uint64
+	for {
+		b, err := rd.ReadByte()
+		if err == io.EOF {
+			if len(buf) < 1 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b)
+		h = (h << 1) + gearTable[b]
+		if len(buf) < minChunkSize {
+			continue
+		}
+		if h&chunkMask == 0 || len(buf) >= maxChunkSize {
+			return buf, nil
+		}
+	}
+}
+
+type chunkReader struct {
+	store  *chunkStore
+	chunks []Chunk
+	cur    io.ReadCloser
+	hash   hash.Hash
+	size   int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.chunks) < 1 {
+				return 0, io.EOF
+			}
+			f, err := r.store.storage.Get(r.store.name(r.chunks[0].Hash), 0)
+			if err != nil {
+				return 0, err
+			}
+			r.cur = f
+			r.hash = sha256.New()
+			r.size = 0
+		}
+
+		n, err := r.cur.Read(p)
+		r.hash.Write(p[:n])
+		r.size += int64(n)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			chunk := r.chunks[0]
+			r.chunks = r.chunks[1:]
+			if r.size != chunk.Size || hex.EncodeToString(r.hash.Sum(nil)) != chunk.Hash {
+				return n, fmt.Errorf("corrupted chunk: %s", chunk.Hash)
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
@@ -0,0 +1,99 @@
+package goback
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func putChunks(t *testing.T, c *chunkStore, data []byte) []Chunk {
+	t.Helper()
+	chunks, err := c.Put(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+func readChunks(t *testing.T, c *chunkStore, chunks []Chunk) []byte {
+	t.Helper()
+	r := c.Open(chunks)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Chunk boundaries depend on the content, so data shifted by an insertion shares its later chunks
+func TestChunkStoreBoundaries(t *testing.T) {
+	c := newChunkStore(newLocalStorage(t.TempDir()))
+	data := randomData(24<<20, 1)
+	chunks := putChunks(t, c, data)
+
+	var size int64
+	for i, chunk := range chunks {
+		if chunk.Size > maxChunkSize || (chunk.Size < minChunkSize && i < len(chunks)-1) {
+			t.Errorf("chunk %d: %d bytes", i, chunk.Size)
+		}
+		size += chunk.Size
+	}
+	if size != int64(len(data)) || len(chunks) < 3 {
+		t.Fatalf("%d bytes in %d chunks", size, len(chunks))
+	}
+	if got := readChunks(t, c, chunks); !bytes.Equal(got, data) {
+		t.Fatal("reassembled data differs")
+	}
+
+	shifted := append([]byte("inserted"), data...)
+	shiftedChunks := putChunks(t, c, shifted)
+	if got := readChunks(t, c, shiftedChunks); !bytes.Equal(got, shifted) {
+		t.Fatal("reassembled shifted data differs")
+	}
+	if !reflect.DeepEqual(shiftedChunks[1:], chunks[1:]) {
+		t.Errorf("chunks after the insertion differ: %d of %d", len(shiftedChunks), len(chunks))
+	}
+
+	// Data without boundaries is cut at the maximum size
+	zeros := make([]byte, 2*maxChunkSize+1)
+	zeroChunks := putChunks(t, c, zeros)
+	if len(zeroChunks) != 3 || zeroChunks[0] != zeroChunks[1] || zeroChunks[2].Size != 1 {
+		t.Errorf("zeros chunked as %v", zeroChunks)
+	}
+}
+
+// A file stored again, by a later backup, writes no chunk
+func TestChunkStoreReuse(t *testing.T) {
+	storage := newLocalStorage(t.TempDir())
+	data := randomData(4<<20, 2)
+	first := newChunkStore(storage)
+	chunks := putChunks(t, first, data)
+	if first.NewChunks != uint32(len(chunks)) || first.NewSize != uint64(len(data)) {
+		t.Errorf("first store: %d chunks of %d bytes", first.NewChunks, first.NewSize)
+	}
+
+	second := newChunkStore(storage)
+	if again := putChunks(t, second, data); !reflect.DeepEqual(again, chunks) {
+		t.Errorf("manifest differs: %v, want %v", again, chunks)
+	}
+	if second.NewChunks != 0 {
+		t.Errorf("%d chunks written again", second.NewChunks)
+	}
+
+	objects, err := storage.List(chunkDir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(chunks) {
+		t.Errorf("%d chunks stored, want %d", len(objects), len(chunks))
+	}
+}
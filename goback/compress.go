@@ -0,0 +1,119 @@
+package goback
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs of stored copies
+const (
+	CodecNone = ""
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+)
+
+// Extensions of already compressed formats, which are stored as they are
+var compressedExts = []string{
+	".7z", ".apk", ".avi", ".br", ".bz2", ".docx", ".flac", ".gz", ".heic", ".jar", ".jpeg", ".jpg", ".lz4",
+	".mkv", ".mov", ".mp3", ".mp4", ".ogg", ".png", ".pptx", ".rar", ".tgz", ".webm", ".webp", ".xlsx", ".xz", ".zip", ".zst",
+}
+
+// checkCodec checks a codec and its level; level 0 is the default level of the codec
+func checkCodec(codec string, level int) error {
+	switch codec {
+	case CodecNone:
+		return nil
+	case CodecGzip:
+		if level < 0 || level > gzip.BestCompression {
+			return fmt.Errorf("invalid gzip level: %d", level)
+		}
+	case CodecZstd:
+		if level < 0 || level > 22 {
+			return fmt.Errorf("invalid zstd level: %d", level)
+		}
+	default:
+		return fmt.Errorf("unknown compression: %s", codec)
+	}
+	return nil
+}
+
+// codecFor returns the codec a file is stored with
+func (o *Options) codecFor(path string) string {
+	if o.Compression == CodecNone || !o.compressible(path) {
+		return CodecNone
+	}
+	return o.Compression
+}
+
+// compressible tells whether a file is worth compressing by its extension
+func (o *Options) compressible(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, e := range compressedExts {
+		if ext == e {
+			return false
+		}
+	}
+	for _, e := range o.SkipCompress {
+		if ext == strings.ToLower(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func newCompressor(w io.Writer, codec string, level int) (io.WriteCloser, error) {
+	switch codec {
+	case CodecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CodecZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	}
+	return nil, fmt.Errorf("unknown compression: %s", codec)
+}
+
+// newDecompressor returns a reader of the original content of a stored copy. Closing it closes r.
+func newDecompressor(r io.ReadCloser, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecNone:
+		return r, nil
+	case CodecGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &decompressor{Reader: zr, close: zr.Close, src: r}, nil
+	case CodecZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &decompressor{Reader: zr, close: func() error { zr.Close(); return nil }, src: r}, nil
+	}
+	return nil, fmt.Errorf("unknown compression: %s", codec)
+}
+
+type decompressor struct {
+	io.Reader
+	close func() error
+	src   io.Closer
+}
+
+func (d *decompressor) Close() error {
+	err := d.close()
+	if err := d.src.Close(); err != nil {
+		return err
+	}
+	return err
+}
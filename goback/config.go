@@ -0,0 +1,301 @@
+package goback
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v2"
+)
+
+// Config describes named backup jobs. Configuration files are YAML; TOML is not supported.
+//
+//	jobs:
+//	  - name: home
+//	    schedule: "5 0 * * *"
+//	    sources: [/home/data, /etc]
+//	    destination: /backup
+//	    excludes: [node_modules/, "*.tmp"]
+//	    workers: 4
+//	    compression: zstd
+//	    retention:
+//	      keep_daily: 60
+//	    hooks:
+//	      on_failure: ["mail -s 'backup failed' root < /dev/null"]
+type Config struct {
+	Jobs []*JobConfig `yaml:"jobs"`
+}
+
+type JobConfig struct {
+	Name           string          `yaml:"name"`
+	Schedule       string          `yaml:"schedule"` // Cron expression used by the daemon
+	Sources        []string        `yaml:"sources"`
+	Destination    string          `yaml:"destination"`
+	Excludes       []string        `yaml:"excludes"`
+	ExcludeFrom    string          `yaml:"exclude_from"`
+	Workers        int             `yaml:"workers"`
+	BatchSize      int             `yaml:"batch_size"` // Rows written to the databases per insert statement
+	Checksum       bool            `yaml:"checksum"`
+	Dedup          bool            `yaml:"dedup"`
+	WaitLock       bool            `yaml:"wait_lock"`   // Wait for other backups of the destination
+	Compression    string          `yaml:"compression"` // gzip or zstd
+	Level          int             `yaml:"compression_level"`
+	SkipCompress   []string        `yaml:"skip_compress"`   // Extensions stored uncompressed
+	PassphraseFile string          `yaml:"passphrase_file"` // File of the passphrase encrypting copies, not catalogs; GOBACK_PASSPHRASE if not set. Not with dedup, archive or snapshot
+	Archive        string          `yaml:"archive"`         // tar.zst or zip
+	Snapshot       bool            `yaml:"snapshot"`        // Complete dated trees with hard links to unchanged files
+	Storage        string          `yaml:"storage"`         // Where copies are stored, e.g. s3://bucket/prefix or sftp://user@host/path
+	Retention      RetentionConfig `yaml:"retention"`
+	Hooks          HookConfig      `yaml:"hooks"`
+}
+
+type RetentionConfig struct {
+	KeepLast    int `yaml:"keep_last"`
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+}
+
+// HookConfig has shell commands run after a job. GOBACK_JOB, GOBACK_STATUS
+// (success, partial or failure) and GOBACK_ERROR are set in their environment.
+// Partial runs, which have failed files, run the failure hooks.
+type HookConfig struct {
+	OnSuccess []string `yaml:"on_success"`
+	OnFailure []string `yaml:"on_failure"`
+}
+
+// LoadConfig reads and validates a job configuration file
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err.Error())
+	}
+	return c, nil
+}
+
+// Validate checks every job, so that nothing runs if any of them is invalid
+func (c *Config) Validate() error {
+	if len(c.Jobs) < 1 {
+		return errors.New("no job")
+	}
+
+	names := make(map[string]bool)
+	for i, jc := range c.Jobs {
+		if jc.Name == "" {
+			return fmt.Errorf("job #%d: no name", i+1)
+		}
+		if names[jc.Name] {
+			return fmt.Errorf("duplicate job: %s", jc.Name)
+		}
+		names[jc.Name] = true
+
+		if err := jc.Validate(); err != nil {
+			return fmt.Errorf("job %s: %s", jc.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// Select returns the named jobs, or every job if no name is given
+func (c *Config) Select(names []string) ([]*JobConfig, error) {
+	if len(names) < 1 {
+		return c.Jobs, nil
+	}
+
+	jobs := make([]*JobConfig, 0, len(names))
+	for _, name := range names {
+		jc := c.Job(name)
+		if jc == nil {
+			return nil, fmt.Errorf("job not found: %s", name)
+		}
+		jobs = append(jobs, jc)
+	}
+	return jobs, nil
+}
+
+func (c *Config) Job(name string) *JobConfig {
+	for _, jc := range c.Jobs {
+		if jc.Name == name {
+			return jc
+		}
+	}
+	return nil
+}
+
+func (jc *JobConfig) Validate() error {
+	if len(jc.Sources) < 1 {
+		return errors.New("no source")
+	}
+	for _, dir := range jc.Sources {
+		if err := checkDir(dir); err != nil {
+			return err
+		}
+	}
+	if jc.Destination == "" {
+		return errors.New("no destination")
+	}
+	if err := checkDir(jc.Destination); err != nil {
+		return err
+	}
+	if jc.Schedule != "" {
+		if _, err := cron.ParseStandard(jc.Schedule); err != nil {
+			return fmt.Errorf("invalid schedule: %s", err.Error())
+		}
+	}
+	if jc.Workers < 0 {
+		return fmt.Errorf("invalid workers: %d", jc.Workers)
+	}
+	r := jc.Retention
+	if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepWeekly < 0 || r.KeepMonthly < 0 || r.KeepYearly < 0 {
+		return errors.New("invalid retention")
+	}
+
+	job, err := jc.NewJob(false)
+	if err != nil {
+		return err
+	}
+	if err := job.Validate(); err != nil {
+		return err
+	}
+	return job.Options.Validate()
+}
+
+// NewJob returns the backup job described by the configuration
+func (jc *JobConfig) NewJob(debug bool) (*Job, error) {
+	j := NewJob(jc.Name, jc.Sources, jc.Destination, debug)
+	j.Options.Checksum = jc.Checksum
+	j.Options.Dedup = jc.Dedup
+	j.Options.WaitLock = jc.WaitLock
+	j.Options.Compression = jc.Compression
+	j.Options.CompressionLevel = jc.Level
+	j.Options.SkipCompress = jc.SkipCompress
+	j.Options.Archive = jc.Archive
+	j.Options.Snapshot = jc.Snapshot
+	j.Options.StorageURL = jc.Storage
+	passphrase, err := ReadPassphrase(jc.PassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	j.Options.Passphrase = passphrase
+	if jc.Workers > 0 {
+		j.Options.Workers = jc.Workers
+	}
+	if jc.BatchSize != 0 {
+		j.Options.BatchSize = jc.BatchSize
+	}
+	if jc.ExcludeFrom != "" {
+		patterns, err := ReadPatterns(jc.ExcludeFrom)
+		if err != nil {
+			return nil, err
+		}
+		j.Options.Excludes = append(j.Options.Excludes, patterns...)
+	}
+	j.Options.Excludes = append(j.Options.Excludes, jc.Excludes...)
+	return j, nil
+}
+
+func (jc *JobConfig) RetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		Last:    jc.Retention.KeepLast,
+		Daily:   jc.Retention.KeepDaily,
+		Weekly:  jc.Retention.KeepWeekly,
+		Monthly: jc.Retention.KeepMonthly,
+		Yearly:  jc.Retention.KeepYearly,
+	}
+}
+
+// Run backs up the job, prunes expired backups if a retention policy is set and runs the hooks
+func (jc *JobConfig) Run(debug bool) error {
+	log.Infof("running job: %s", jc.Name)
+	err := jc.run(debug)
+	jc.runHooks(err)
+	return err
+}
+
+func (jc *JobConfig) run(debug bool) error {
+	job, err := jc.NewJob(debug)
+	if err != nil {
+		return err
+	}
+	// A partial run is kept, so the retention policy still applies
+	runErr := job.Run()
+	if runErr != nil && !IsPartial(runErr) {
+		return runErr
+	}
+
+	policy := jc.RetentionPolicy()
+	if policy.empty() {
+		return runErr
+	}
+	p := NewPrune(jc.Destination, policy, debug)
+	p.Jobs = []string{jc.Name}
+	p.WaitLock = jc.WaitLock
+	if err := p.Initialize(); err != nil {
+		return err
+	}
+	err = p.Prune()
+	p.Close()
+	if err != nil {
+		return err
+	}
+	return runErr
+}
+
+func (jc *JobConfig) runHooks(jobErr error) {
+	status := "success"
+	hooks := jc.Hooks.OnSuccess
+	var message string
+	if jobErr != nil {
+		status = "failure"
+		if IsPartial(jobErr) {
+			status = "partial"
+		}
+		hooks = jc.Hooks.OnFailure
+		message = jobErr.Error()
+	}
+
+	for _, hook := range hooks {
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", hook)
+		} else {
+			cmd = exec.Command("sh", "-c", hook)
+		}
+		cmd.Env = append(os.Environ(),
+			"GOBACK_JOB="+jc.Name,
+			"GOBACK_STATUS="+status,
+			"GOBACK_ERROR="+message,
+		)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Errorf("hook failed: %s: %s: %s", hook, err.Error(), out)
+			continue
+		}
+		log.Debugf("hook: %s: %s", hook, out)
+	}
+}
+
+func checkDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+	return nil
+}
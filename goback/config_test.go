@@ -0,0 +1,210 @@
+package goback
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A configuration file is read into jobs; unknown keys and other formats are rejected
+func TestLoadConfig(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	dir := t.TempDir()
+	load := func(content string) (*Config, error) {
+		t.Helper()
+		file := filepath.Join(dir, "jobs.yaml")
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadConfig(file)
+	}
+
+	c, err := load(`
+jobs:
+  - name: home
+    schedule: "5 0 * * *"
+    sources: [` + srcDir + `]
+    destination: ` + dstDir + `
+    excludes: ["*.tmp"]
+    workers: 3
+    compression: zstd
+    retention:
+      keep_daily: 7
+    hooks:
+      on_failure: ["true"]
+  - name: etc
+    sources: [` + srcDir + `]
+    destination: ` + dstDir + `
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Config{Jobs: []*JobConfig{
+		{
+			Name:        "home",
+			Schedule:    "5 0 * * *",
+			Sources:     []string{srcDir},
+			Destination: dstDir,
+			Excludes:    []string{"*.tmp"},
+			Workers:     3,
+			Compression: "zstd",
+			Retention:   RetentionConfig{KeepDaily: 7},
+			Hooks:       HookConfig{OnFailure: []string{"true"}},
+		},
+		{Name: "etc", Sources: []string{srcDir}, Destination: dstDir},
+	}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("loaded %+v, want %+v", c, want)
+	}
+
+	invalid := map[string]string{
+		"unknown key": "jobs:\n  - name: home\n    source: [" + srcDir + "]\n    destination: " + dstDir + "\n",
+		"invalid job": "jobs:\n  - name: home\n    destination: " + dstDir + "\n",
+		"toml":        "[[jobs]]\nname = \"home\"\nsources = [\"" + srcDir + "\"]\ndestination = \"" + dstDir + "\"\n",
+		"empty":       "",
+	}
+	for name, content := range invalid {
+		if _, err := load(content); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "none.yaml")); err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+// Validate rejects a configuration if any of its jobs is invalid
+func TestConfigValidate(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	file := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := func(change func(*JobConfig)) *JobConfig {
+		jc := &JobConfig{Name: "job", Sources: []string{srcDir}, Destination: dstDir}
+		if change != nil {
+			change(jc)
+		}
+		return jc
+	}
+	valid := job(nil)
+
+	tests := []struct {
+		name string
+		jobs []*JobConfig
+		err  string
+	}{
+		{"valid", []*JobConfig{valid, job(func(jc *JobConfig) { jc.Name = "other"; jc.Schedule = "@daily" })}, ""},
+		{"no job", nil, "no job"},
+		{"no name", []*JobConfig{job(func(jc *JobConfig) { jc.Name = "" })}, "no name"},
+		{"duplicate job", []*JobConfig{valid, job(nil)}, "duplicate job"},
+		{"no source", []*JobConfig{job(func(jc *JobConfig) { jc.Sources = nil })}, "no source"},
+		{"missing source", []*JobConfig{job(func(jc *JobConfig) { jc.Sources = []string{filepath.Join(srcDir, "none")} })}, "no such file"},
+		{"source not a directory", []*JobConfig{job(func(jc *JobConfig) { jc.Sources = []string{file} })}, "not a directory"},
+		{"duplicate source", []*JobConfig{job(func(jc *JobConfig) { jc.Sources = []string{srcDir, srcDir + "/"} })}, "duplicate source"},
+		{"no destination", []*JobConfig{job(func(jc *JobConfig) { jc.Destination = "" })}, "no destination"},
+		{"destination not a directory", []*JobConfig{job(func(jc *JobConfig) { jc.Destination = file })}, "not a directory"},
+		{"schedule", []*JobConfig{job(func(jc *JobConfig) { jc.Schedule = "every day" })}, "invalid schedule"},
+		{"workers", []*JobConfig{job(func(jc *JobConfig) { jc.Workers = -1 })}, "invalid workers"},
+		{"retention", []*JobConfig{job(func(jc *JobConfig) { jc.Retention.KeepWeekly = -1 })}, "invalid retention"},
+		{"batch size", []*JobConfig{job(func(jc *JobConfig) { jc.BatchSize = -1 })}, "invalid batch size"},
+		{"compression", []*JobConfig{job(func(jc *JobConfig) { jc.Compression = "lz4" })}, "lz4"},
+		{"dedup with compression", []*JobConfig{job(func(jc *JobConfig) { jc.Dedup = true; jc.Compression = "gzip" })}, "dedup"},
+		{"exclude pattern", []*JobConfig{job(func(jc *JobConfig) { jc.Excludes = []string{"["} })}, "invalid pattern"},
+		{"exclude file", []*JobConfig{job(func(jc *JobConfig) { jc.ExcludeFrom = filepath.Join(srcDir, "none") })}, "no such file"},
+		{"storage", []*JobConfig{job(func(jc *JobConfig) { jc.Storage = "ftp://host/path" })}, "ftp"},
+		{"invalid second job", []*JobConfig{valid, job(func(jc *JobConfig) { jc.Name = "second"; jc.Sources = nil })}, "job second: no source"},
+	}
+	for _, tt := range tests {
+		err := (&Config{Jobs: tt.jobs}).Validate()
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// Select returns the named jobs in the order given, or every job
+func TestConfigSelect(t *testing.T) {
+	c := &Config{Jobs: []*JobConfig{{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+	names := func(jobs []*JobConfig) []string {
+		var names []string
+		for _, jc := range jobs {
+			names = append(names, jc.Name)
+		}
+		return names
+	}
+
+	jobs, err := c.Select(nil)
+	if err != nil || !reflect.DeepEqual(names(jobs), []string{"a", "b", "c"}) {
+		t.Errorf("selected %v, %v, want every job", names(jobs), err)
+	}
+	jobs, err = c.Select([]string{"c", "a"})
+	if err != nil || !reflect.DeepEqual(names(jobs), []string{"c", "a"}) {
+		t.Errorf("selected %v, %v, want c and a", names(jobs), err)
+	}
+	if _, err := c.Select([]string{"a", "d"}); err == nil {
+		t.Error("unknown job selected")
+	}
+}
+
+// The hooks of the outcome run with the job, its status and its error in their environment
+func TestJobConfigHooks(t *testing.T) {
+	srcDir, dstDir, dir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a"})
+	out := filepath.Join(dir, "hook.out")
+	hook := `echo "$GOBACK_JOB $GOBACK_STATUS $GOBACK_ERROR" >> ` + out
+	hookRun := func() string {
+		t.Helper()
+		data, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	jc := &JobConfig{
+		Name:        "home",
+		Sources:     []string{srcDir},
+		Destination: dstDir,
+		Hooks: HookConfig{
+			OnSuccess: []string{hook},
+			OnFailure: []string{hook},
+		},
+	}
+	if err := jc.Run(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := hookRun(); got != "home success" {
+		t.Errorf("hook ran with %q", got)
+	}
+
+	// A failed hook neither stops the next one nor changes the outcome
+	jc.Hooks.OnSuccess = []string{"exit 1", hook}
+	if err := jc.Run(false); err != nil {
+		t.Fatal(err)
+	}
+	if got := hookRun(); !strings.HasSuffix(got, "\nhome success") {
+		t.Errorf("hook ran with %q", got)
+	}
+
+	jc.Sources = []string{filepath.Join(srcDir, "none")}
+	err := jc.Run(false)
+	if err == nil {
+		t.Fatal("job with a missing source succeeded")
+	}
+	lines := strings.Split(hookRun(), "\n")
+	if got, want := lines[len(lines)-1], "home failure "+err.Error(); got != want {
+		t.Errorf("hook ran with %q, want %q", got, want)
+	}
+	if len(lines) != 3 {
+		t.Errorf("hooks ran %d times, want 3", len(lines))
+	}
+}
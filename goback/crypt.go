@@ -0,0 +1,310 @@
+package goback
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Copies are encrypted with AES-256-GCM using a key derived from a passphrase.
+// The key file in the backup directory has the key derivation parameters and
+// a sealed known value, so that a wrong passphrase is detected before any data is read.
+const (
+	keyFileName    = "goback.key"
+	encSegmentSize = 64 << 10
+)
+
+var (
+	ErrPassphraseRequired = errors.New("backup directory is encrypted; passphrase required")
+	ErrWrongPassphrase    = errors.New("wrong passphrase")
+
+	encMagic = []byte("GBE1")
+	keyCheck = []byte("goback key check")
+)
+
+type keyFile struct {
+	KDF   string `json:"kdf"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"` // Nonce and sealed key check value
+}
+
+// ReadPassphrase reads the first line of file, or GOBACK_PASSPHRASE if no file is given
+func ReadPassphrase(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("GOBACK_PASSPHRASE"), nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	return strings.TrimRight(line, "\r"), nil
+}
+
+// loadKey returns the key of an encrypted backup directory, or nil if it is not encrypted
+func loadKey(dstDir, passphrase string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dstDir, keyFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, ErrPassphraseRequired
+	}
+
+	kf := keyFile{}
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, fmt.Errorf("invalid key file: %s", err.Error())
+	}
+	if kf.KDF != "scrypt" {
+		return nil, fmt.Errorf("unknown key derivation: %s", kf.KDF)
+	}
+	key, err := scrypt.Key([]byte(passphrase), kf.Salt, kf.N, kf.R, kf.P, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(kf.Check) < aead.NonceSize() {
+		return nil, errors.New("invalid key file: key check")
+	}
+	plain, err := aead.Open(nil, kf.Check[:aead.NonceSize()], kf.Check[aead.NonceSize():], nil)
+	if err != nil || !bytes.Equal(plain, keyCheck) {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// initKey returns the key of a backup directory. The directory is set up for
+// encryption if it is not encrypted yet and a passphrase is given.
+func initKey(dstDir, passphrase string) ([]byte, error) {
+	key, err := loadKey(dstDir, passphrase)
+	if err != nil || key != nil || passphrase == "" {
+		return key, err
+	}
+
+	kf := keyFile{
+		KDF:  "scrypt",
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+		Salt: make([]byte, 16),
+	}
+	if _, err := rand.Read(kf.Salt); err != nil {
+		return nil, err
+	}
+	key, err = scrypt.Key([]byte(passphrase), kf.Salt, kf.N, kf.R, kf.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	kf.Check = aead.Seal(nonce, nonce, keyCheck, nil)
+
+	data, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dstDir, keyFileName), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted copies are a magic number and a random salt followed by segments
+// of sealed data. Each copy is sealed with its own key, derived from the key of
+// the directory and the salt by HKDF, so that nonces never repeat under one key
+// however many copies there are. The nonce of a segment is the segment number
+// and a flag marking the last segment, so reordered or truncated segments fail
+// to open.
+const encSaltSize = 32
+
+type segmentNonce [12]byte
+
+// fileAEAD returns the cipher of a copy with the salt
+func fileAEAD(key, salt []byte) (cipher.AEAD, error) {
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte("goback file key")), fileKey); err != nil {
+		return nil, err
+	}
+	return newAEAD(fileKey)
+}
+
+func (n *segmentNonce) set(counter uint32, last bool) []byte {
+	binary.BigEndian.PutUint32(n[7:11], counter)
+	n[11] = 0
+	if last {
+		n[11] = 1
+	}
+	return n[:]
+}
+
+type encrypter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	nonce   segmentNonce
+	counter uint32
+	buf     []byte
+}
+
+func newEncrypter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	salt := make([]byte, encSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(append([]byte{}, encMagic...), salt...)); err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, encSegmentSize),
+	}, nil
+}
+
+func (e *encrypter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		// A full segment is written only when more data follows, so that the last one can be marked
+		if len(e.buf) == encSegmentSize {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encrypter) flush(last bool) error {
+	sealed := e.aead.Seal(nil, e.nonce.set(e.counter, last), e.buf, nil)
+	e.counter++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// Close writes the last segment. It does not close the underlying writer.
+func (e *encrypter) Close() error {
+	return e.flush(true)
+}
+
+type decrypter struct {
+	r       *bufio.Reader
+	src     io.Closer
+	aead    cipher.AEAD
+	nonce   segmentNonce
+	counter uint32
+	seg     []byte
+	buf     []byte
+	done    bool
+}
+
+// newDecrypter returns a reader of the plain content of an encrypted copy. Closing it closes r.
+func newDecrypter(r io.ReadCloser, key []byte) (io.ReadCloser, error) {
+	rd := bufio.NewReaderSize(r, encSegmentSize+64)
+	header := make([]byte, len(encMagic)+encSaltSize)
+	if _, err := io.ReadFull(rd, header); err != nil || !bytes.Equal(header[:len(encMagic)], encMagic) {
+		return nil, errors.New("not an encrypted copy")
+	}
+	aead, err := fileAEAD(key, header[len(encMagic):])
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		r:    rd,
+		src:  r,
+		aead: aead,
+		seg:  make([]byte, encSegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.buf) < 1 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.readSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decrypter) readSegment() error {
+	n, err := io.ReadFull(d.r, d.seg)
+	last := false
+	switch err {
+	case nil:
+		_, err := d.r.Peek(1)
+		last = err == io.EOF
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return err
+	}
+
+	plain, err := d.aead.Open(d.seg[:0], d.nonce.set(d.counter, last), d.seg[:n], nil)
+	if err != nil {
+		return errors.New("decryption failed: wrong key or corrupted copy")
+	}
+	d.counter++
+	d.buf = plain
+	d.done = last
+	return nil
+}
+
+func (d *decrypter) Close() error {
+	return d.src.Close()
+}
@@ -0,0 +1,79 @@
+package goback
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func encrypt(t *testing.T, key, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc, err := newEncrypter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := enc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decrypt(key, sealed []byte) ([]byte, error) {
+	dec, err := newDecrypter(ioutil.NopCloser(bytes.NewReader(sealed)), key)
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return ioutil.ReadAll(dec)
+}
+
+func TestEncrypter(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, size := range []int{0, 1, encSegmentSize, encSegmentSize + 1, 3 * encSegmentSize} {
+		data := bytes.Repeat([]byte("goback"), size/6+1)[:size]
+		sealed := encrypt(t, key, data)
+		got, err := decrypt(key, sealed)
+		if err != nil {
+			t.Fatalf("%d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: %d bytes decrypted", size, len(got))
+		}
+
+		// Truncated
+		if size > encSegmentSize {
+			if _, err := decrypt(key, sealed[:len(sealed)-encSegmentSize]); err == nil {
+				t.Errorf("%d bytes: truncated copy decrypted", size)
+			}
+		}
+	}
+
+	if _, err := decrypt(bytes.Repeat([]byte{2}, 32), encrypt(t, key, []byte("data"))); err == nil {
+		t.Error("decrypted with a wrong key")
+	}
+}
+
+// Each copy is sealed with its own key
+func TestEncrypterFileKey(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	data := []byte("same data")
+	a, b := encrypt(t, key, data), encrypt(t, key, data)
+	header := len(encMagic) + encSaltSize
+	if bytes.Equal(a[:header], b[:header]) || bytes.Equal(a[header:], b[header:]) {
+		t.Error("copies sealed alike")
+	}
+
+	// The sealed data does not open with the key of the directory
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce segmentNonce
+	if _, err := aead.Open(nil, nonce.set(0, true), a[header:], nil); err == nil {
+		t.Error("copy sealed with the key of the directory")
+	}
+}
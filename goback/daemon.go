@@ -0,0 +1,259 @@
+package goback
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Missed runs recorded at most per job when the daemon starts
+const maxMissedRuns = 100
+
+// Daemon runs the scheduled jobs of a configuration
+type Daemon struct {
+	jobs  []*scheduledJob
+	debug bool
+
+	dstLocks sync.Map
+	wg       sync.WaitGroup
+}
+
+type scheduledJob struct {
+	*JobConfig
+	schedule cron.Schedule
+	running  int32
+}
+
+func NewDaemon(config *Config, debug bool) (*Daemon, error) {
+	d := &Daemon{
+		debug: debug,
+	}
+	for _, jc := range config.Jobs {
+		if jc.Schedule == "" {
+			log.Warnf("job %s has no schedule", jc.Name)
+			continue
+		}
+		schedule, err := cron.ParseStandard(jc.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		// Scheduled runs wait for backups started by hand
+		jc.WaitLock = true
+		d.jobs = append(d.jobs, &scheduledJob{
+			JobConfig: jc,
+			schedule:  schedule,
+		})
+	}
+	if len(d.jobs) < 1 {
+		return nil, errors.New("no scheduled job")
+	}
+	return d, nil
+}
+
+// Run schedules the jobs until stop is closed, then waits for running jobs to finish
+func (d *Daemon) Run(stop <-chan struct{}) {
+	if d.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	loops := sync.WaitGroup{}
+	for _, sj := range d.jobs {
+		if err := d.recordMissedSinceLastRun(sj); err != nil {
+			log.Error(err)
+		}
+
+		loops.Add(1)
+		go func(sj *scheduledJob) {
+			defer loops.Done()
+			d.loop(sj, stop)
+		}(sj)
+	}
+	loops.Wait()
+
+	log.Info("waiting for running jobs")
+	d.wg.Wait()
+}
+
+func (d *Daemon) loop(sj *scheduledJob, stop <-chan struct{}) {
+	next := sj.schedule.Next(time.Now())
+	for {
+		log.Infof("next run of job %s: %s", sj.Name, next.Format(time.RFC3339))
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// Scheduled times passed while the system was asleep
+		now := time.Now()
+		var missed []time.Time
+		for t := sj.schedule.Next(next); !t.After(now); t = sj.schedule.Next(t) {
+			missed = append(missed, t)
+		}
+		if len(missed) > 0 {
+			d.record(sj, missed, StateMissed, "missed: system was asleep")
+		}
+
+		d.start(sj, next)
+		next = sj.schedule.Next(now)
+	}
+}
+
+// start runs a job unless its previous run is still running.
+// Jobs with the same destination run one at a time.
+func (d *Daemon) start(sj *scheduledJob, scheduled time.Time) {
+	if !atomic.CompareAndSwapInt32(&sj.running, 0, 1) {
+		d.record(sj, []time.Time{scheduled}, StateSkipped, "skipped: previous run still running")
+		return
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer atomic.StoreInt32(&sj.running, 0)
+
+		defer d.lockDst(sj.Destination).Unlock()
+
+		err := sj.Run(d.debug)
+		if IsPartial(err) {
+			log.Warnf("job %s completed with failures: %s", sj.Name, err.Error())
+		} else if err != nil {
+			log.Errorf("job %s failed: %s", sj.Name, err.Error())
+		}
+	}()
+}
+
+// recordMissedSinceLastRun records the scheduled times passed while the daemon was not running
+func (d *Daemon) recordMissedSinceLastRun(sj *scheduledJob) error {
+	db, err := openLogDB(sj.Destination)
+	if err != nil || db == nil {
+		return err
+	}
+	defer db.Close()
+
+	// Records of missed runs may be written after later runs
+	rows, err := db.Query("select date from bak_summary where job = ?", sj.Name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var last time.Time
+	for rows.Next() {
+		var date string
+		if err := rows.Scan(&date); err != nil {
+			return err
+		}
+		if t, err := time.Parse(time.RFC3339, date); err == nil && t.After(last) {
+			last = t
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if last.IsZero() {
+		return nil
+	}
+
+	now := time.Now()
+	var missed []time.Time
+	for t := sj.schedule.Next(last); !t.After(now); t = sj.schedule.Next(t) {
+		if len(missed) >= maxMissedRuns {
+			log.Warnf("job %s missed more than %d runs", sj.Name, maxMissedRuns)
+			break
+		}
+		missed = append(missed, t)
+	}
+	if len(missed) > 0 {
+		d.record(sj, missed, StateMissed, "missed: daemon was not running")
+	}
+	return nil
+}
+
+// record writes runs which did not happen to the log database, one row per run and source.
+// Backups keep the database locked while they run, so the rows are written in the
+// background once the destination is free.
+func (d *Daemon) record(sj *scheduledJob, scheduled []time.Time, state int, message string) {
+	for _, t := range scheduled {
+		log.Warnf("job %s %s at %s", sj.Name, message, t.Format(time.RFC3339))
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if err := d.insertSummaries(sj, scheduled, state, message); err != nil {
+			log.Errorf("recording runs of job %s: %s", sj.Name, err.Error())
+		}
+	}()
+}
+
+func (d *Daemon) insertSummaries(sj *scheduledJob, scheduled []time.Time, state int, message string) error {
+	defer d.lockDst(sj.Destination).Unlock()
+	lock, err := acquireLock(sj.Destination, true)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	db, err := openLogDB(sj.Destination)
+	if err == nil && db == nil {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, t := range scheduled {
+		for _, srcDir := range sj.Sources {
+			_, err := tx.Exec("insert into bak_summary(date, job, src_dir, state, message) values(?, ?, ?, ?, ?)",
+				t.Format(time.RFC3339),
+				sj.Name,
+				filepath.Clean(srcDir),
+				state,
+				message,
+			)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// lockDst locks a destination against the other runs and records of the daemon
+func (d *Daemon) lockDst(dstDir string) *sync.Mutex {
+	lock, _ := d.dstLocks.LoadOrStore(filepath.Clean(dstDir), &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex)
+}
+
+// openLogDB opens the log database of a destination. It returns nil if there is no destination directory.
+func openLogDB(dstDir string) (*sql.DB, error) {
+	if _, err := os.Stat(dstDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(filepath.Clean(dstDir), "backup_log.db"))
+	if err != nil {
+		return nil, err
+	}
+	if err := initLogDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,122 @@
+package goback
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Scheduled times passed while the daemon was not running are recorded once,
+// one row per source
+func TestDaemonRecordsMissedRuns(t *testing.T) {
+	src1, src2, dstDir := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFiles(t, src1, map[string]string{"a.txt": "a"})
+	s, err := runBackup(t, src1, dstDir, func(o *Options) { o.Job = "hourly" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := time.Now().Add(-210 * time.Minute).Truncate(time.Second)
+	setDate(t, dstDir, s.ID, last)
+
+	d := newTestDaemon(t, "hourly", "@every 1h", dstDir, src1, src2)
+	if err := d.recordMissedSinceLastRun(d.jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	d.wg.Wait()
+
+	var want []string
+	for h := 1; h <= 3; h++ {
+		date := last.Add(time.Duration(h) * time.Hour).Format(time.RFC3339)
+		want = append(want, date+" "+src1, date+" "+src2)
+	}
+	if got := recordedRuns(t, dstDir, StateMissed); !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded %v, want %v", got, want)
+	}
+
+	// The next start finds the recorded runs
+	if err := d.recordMissedSinceLastRun(d.jobs[0]); err != nil {
+		t.Fatal(err)
+	}
+	d.wg.Wait()
+	if got := recordedRuns(t, dstDir, StateMissed); len(got) != len(want) {
+		t.Errorf("recorded again: %v", got)
+	}
+}
+
+// A run due while the previous one still runs is skipped and recorded once the
+// backup has released the destination
+func TestDaemonSkipsOverlappingRun(t *testing.T) {
+	defer func(retry time.Duration) {
+		lockRetry = retry
+	}(lockRetry)
+	lockRetry = 10 * time.Millisecond
+
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a"})
+	d := newTestDaemon(t, "often", "@every 1m", dstDir, srcDir)
+	sj := d.jobs[0]
+
+	// The previous run holds the destination
+	b := newTestBackup(t, srcDir, dstDir, func(o *Options) { o.Job = sj.Name })
+	sj.running = 1
+	scheduled := time.Now().Truncate(time.Second)
+	d.start(sj, scheduled)
+	if got := recordedRuns(t, dstDir, StateSkipped); len(got) > 0 {
+		t.Errorf("recorded while the backup runs: %v", got)
+	}
+	if _, err := finishBackup(b); err != nil {
+		t.Fatal(err)
+	}
+	d.wg.Wait()
+
+	want := []string{scheduled.Format(time.RFC3339) + " " + srcDir}
+	if got := recordedRuns(t, dstDir, StateSkipped); !reflect.DeepEqual(got, want) {
+		t.Errorf("recorded %v, want %v", got, want)
+	}
+	if got := restoreTree(t, dstDir, b.S.ID); got["a.txt"] != "a" {
+		t.Errorf("restored %v", got)
+	}
+}
+
+// newTestDaemon returns a daemon of a single job
+func newTestDaemon(t *testing.T, name, schedule, dstDir string, srcDirs ...string) *Daemon {
+	t.Helper()
+	d, err := NewDaemon(&Config{Jobs: []*JobConfig{{
+		Name:        name,
+		Schedule:    schedule,
+		Sources:     srcDirs,
+		Destination: dstDir,
+	}}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// recordedRuns returns the date and source of the runs recorded with a state, in order
+func recordedRuns(t *testing.T, dstDir string, state int) []string {
+	t.Helper()
+	c := newCatalog(dstDir)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	rows, err := c.db.Query("select date, src_dir from bak_summary where state = ? order by id", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var runs []string
+	for rows.Next() {
+		var date, srcDir string
+		if err := rows.Scan(&date, &srcDir); err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, date+" "+filepath.Clean(srcDir))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return runs
+}
@@ -0,0 +1,40 @@
+package goback
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of a backup are either per file or fatal. A file which cannot be read or
+// copied is logged as failed in bak_log and the backup goes on; the run ends as
+// StatePartial and returns a PartialError. Any other error is fatal: the run ends
+// as StateFailed and nothing of it is kept.
+
+// FileError is the failure of a single file or directory
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// PartialError is returned by a backup which completed with failed files
+type PartialError struct {
+	Failed uint32
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d files failed", e.Failed)
+}
+
+// IsPartial tells whether a backup completed with failed files only. Its data can be restored.
+func IsPartial(err error) bool {
+	var pe *PartialError
+	return errors.As(err, &pe)
+}
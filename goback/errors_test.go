@@ -0,0 +1,92 @@
+package goback
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Files which cannot be read or copied fail alone: the backup ends as partial with
+// the other changes, and the next backup stores them
+func TestPartialBackup(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a", "locked/c.txt": "c"})
+	if _, err := runBackup(t, srcDir, dstDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, srcDir, map[string]string{"a.txt": "changed", "blocked.txt": "blocked", "secret.txt": "secret"})
+	want := map[string]string{"a.txt": "changed", "locked/c.txt": "c"}
+	failed := map[string]int{"blocked.txt": -FileAdded}
+	missing := uint32(1)
+
+	// Root reads anything, so only the copy can be made to fail
+	if os.Geteuid() != 0 {
+		if err := os.Chmod(filepath.Join(srcDir, "secret.txt"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(srcDir, "locked"), 0); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(filepath.Join(srcDir, "locked"), 0755)
+		failed["secret.txt"] = -FileAdded
+		missing++
+		failed["locked"] = -FileAdded
+	} else {
+		want["secret.txt"] = "secret"
+	}
+
+	b := newTestBackup(t, srcDir, dstDir, nil)
+	// A directory in the way of the copy
+	if err := os.MkdirAll(filepath.Join(b.tempDir, "blocked.txt", "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	s, err := finishBackup(b)
+	if !IsPartial(err) {
+		t.Fatalf("backup not partial: %v", err)
+	}
+	failures := uint32(len(failed))
+	if s.State != StatePartial || s.BackupFailure != failures {
+		t.Errorf("state %d with %d files failed, want %d", s.State, s.BackupFailure, failures)
+	}
+	for _, v := range loggedVersions(t, dstDir, s.ID) {
+		rel, _ := filepath.Rel(srcDir, v.Path)
+		rel = filepath.ToSlash(rel)
+		if state, ok := failed[rel]; ok {
+			if v.State != state || v.Message == "" {
+				t.Errorf("%s: logged %d %q, want %d", rel, v.State, v.Message, state)
+			}
+			delete(failed, rel)
+		} else if v.State < 0 {
+			t.Errorf("%s failed: %s", rel, v.Message)
+		}
+	}
+	if len(failed) > 0 {
+		t.Errorf("failures not logged: %v", failed)
+	}
+
+	// The failed files are missing from the restore, but not the unreadable directory
+	target := t.TempDir()
+	r := restoreInto(t, dstDir, s.ID, target)
+	if r.Missing != missing || r.Failed > 0 {
+		t.Errorf("%d files missing, %d failed, want %d missing", r.Missing, r.Failed, missing)
+	}
+	if got := readTree(t, target); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+
+	// Files of an unreadable directory are not taken as deleted
+	os.Chmod(filepath.Join(srcDir, "locked"), 0755)
+	os.Chmod(filepath.Join(srcDir, "secret.txt"), 0644)
+	s, err = runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupAdded != missing || s.BackupDeleted > 0 || s.BackupFailure > 0 {
+		t.Errorf("%d added, %d deleted, %d failed", s.BackupAdded, s.BackupDeleted, s.BackupFailure)
+	}
+	if got, want := restoreTree(t, dstDir, s.ID), readTree(t, srcDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,118 @@
+package goback
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Filter excludes paths by gitignore-style patterns. The last matching pattern wins;
+// a pattern starting with "!" includes again what an earlier one excluded.
+// Contents of an excluded directory are never included again.
+type Filter struct {
+	rules []filterRule
+}
+
+type filterRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+func NewFilter(patterns []string) (*Filter, error) {
+	f := &Filter{}
+	for _, pattern := range patterns {
+		p := strings.TrimSpace(pattern)
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+
+		r := filterRule{}
+		if strings.HasPrefix(p, "!") {
+			r.negate = true
+			p = p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			r.dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+
+		// A pattern without a slash matches at any level
+		anchored := strings.Contains(p, "/")
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			return nil, fmt.Errorf("invalid pattern: %s", pattern)
+		}
+		if !anchored {
+			r.segments = append(r.segments, "**")
+		}
+		for _, seg := range strings.Split(p, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern: %s", pattern)
+			}
+			r.segments = append(r.segments, seg)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return f, nil
+}
+
+// ReadPatterns reads patterns from a file, one per line
+func ReadPatterns(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	return patterns, scanner.Err()
+}
+
+// Excluded returns true if rel, a path relative to the source directory, is excluded
+func (f *Filter) Excluded(rel string, isDir bool) bool {
+	rel = strings.Trim(filepath.ToSlash(rel), "/")
+	if rel == "" {
+		return false
+	}
+	name := strings.Split(rel, "/")
+
+	excluded := false
+	for _, r := range f.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if matchSegments(r.segments, name) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) < 1 {
+		return len(name) < 1
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) < 1 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
@@ -0,0 +1,67 @@
+package goback
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		// A pattern without a slash matches at any level
+		{[]string{"*.log"}, "a.log", false, true},
+		{[]string{"*.log"}, "dir/sub/a.log", false, true},
+		{[]string{"*.log"}, "a.log.txt", false, false},
+		{[]string{"build"}, "src/build", true, true},
+
+		// A pattern with a slash is anchored to the source directory
+		{[]string{"/build"}, "build", true, true},
+		{[]string{"/build"}, "src/build", true, false},
+		{[]string{"docs/*.md"}, "docs/a.md", false, true},
+		{[]string{"docs/*.md"}, "x/docs/a.md", false, false},
+		{[]string{"docs/*.md"}, "docs/sub/a.md", false, false},
+
+		// ** matches any number of directories
+		{[]string{"**/tmp"}, "tmp", true, true},
+		{[]string{"**/tmp"}, "a/b/tmp", true, true},
+		{[]string{"a/**/z"}, "a/z", false, true},
+		{[]string{"a/**/z"}, "a/b/c/z", false, true},
+		{[]string{"a/**/z"}, "b/a/z", false, false},
+
+		// A trailing slash matches directories only
+		{[]string{"node_modules/"}, "web/node_modules", true, true},
+		{[]string{"node_modules/"}, "web/node_modules", false, false},
+
+		// The last matching pattern wins
+		{[]string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{[]string{"*.log", "!keep.log"}, "a.log", false, true},
+		{[]string{"!keep.log", "*.log"}, "keep.log", false, true},
+
+		// Comments and blank lines
+		{[]string{"# *.log", "", "  "}, "a.log", false, false},
+		{nil, "a.log", false, false},
+	}
+	for _, tt := range tests {
+		f, err := NewFilter(tt.patterns)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.patterns, err)
+		}
+		if got := f.Excluded(tt.path, tt.isDir); got != tt.excluded {
+			t.Errorf("%q: %s (dir: %v) excluded: %v, want %v", tt.patterns, tt.path, tt.isDir, got, tt.excluded)
+		}
+	}
+}
+
+// An invalid pattern is reported as it was given
+func TestFilterInvalid(t *testing.T) {
+	for _, pattern := range []string{"/", "!/", "//", "a/[b"} {
+		_, err := NewFilter([]string{"*.log", pattern})
+		if err == nil || !strings.HasSuffix(err.Error(), ": "+pattern) {
+			t.Errorf("%q: %v", pattern, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package goback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFiles creates files under dir with their content
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// moveFile moves a file of the source, keeping its size and mtime
+func moveFile(t *testing.T, srcDir, from, to string) {
+	t.Helper()
+	to = filepath.Join(srcDir, filepath.FromSlash(to))
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(srcDir, filepath.FromSlash(from)), to); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTree returns the regular files under dir by slash-separated relative path with their content
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || !f.Mode().IsRegular() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// sameFile tells whether two paths are links to the same file
+func sameFile(t *testing.T, path1, path2 string) bool {
+	t.Helper()
+	f1, err := os.Stat(path1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.Stat(path2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(f1, f2)
+}
+
+// newTestBackup returns an initialized backup of srcDir into dstDir with the options
+// set by setup, which may be nil
+func newTestBackup(t *testing.T, srcDir, dstDir string, setup func(*Options)) *Backup {
+	t.Helper()
+	b := NewBackup(srcDir, dstDir, false)
+	b.Options.Workers = 2
+	if setup != nil {
+		setup(&b.Options)
+	}
+	if err := b.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// finishBackup runs an initialized backup and closes it
+func finishBackup(b *Backup) (*Summary, error) {
+	err := b.Start()
+	if cerr := b.Close(); cerr != nil && (err == nil || IsPartial(err)) {
+		err = cerr
+	}
+	return b.S, err
+}
+
+// runBackup backs up srcDir into dstDir with the options set by setup, which may be nil
+func runBackup(t *testing.T, srcDir, dstDir string, setup func(*Options)) (*Summary, error) {
+	t.Helper()
+	return finishBackup(newTestBackup(t, srcDir, dstDir, setup))
+}
+
+// restoreInto restores a backup into targetDir and returns the restore with its counts
+func restoreInto(t *testing.T, dstDir string, backupID int64, targetDir string) *Restore {
+	t.Helper()
+	r := NewRestore(dstDir, false)
+	if err := r.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	err := r.Restore(backupID, targetDir)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// restoreTree restores a backup into a new directory and returns its files with their content
+func restoreTree(t *testing.T, dstDir string, backupID int64) map[string]string {
+	t.Helper()
+	target := t.TempDir()
+	r := restoreInto(t, dstDir, backupID, target)
+	if r.Failed+r.Missing > 0 {
+		t.Errorf("backup_id=%d: %d files failed, %d missing", backupID, r.Failed, r.Missing)
+	}
+	return readTree(t, target)
+}
+
+// loggedVersions returns the versions logged by a backup
+func loggedVersions(t *testing.T, dstDir string, backupID int64) []*Version {
+	t.Helper()
+	c := newCatalog(dstDir)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	versions, err := c.queryVersions("t1.id = ?", backupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+// countSummaries returns the number of backups in the catalog of dstDir
+func countSummaries(t *testing.T, dstDir string) int {
+	t.Helper()
+	c := newCatalog(dstDir)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	var count int
+	if err := c.db.QueryRow("select count(*) from bak_summary").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// readObject returns the data of a stored object from offset
+func readObject(t *testing.T, s Storage, name string, offset int64) string {
+	t.Helper()
+	r, err := s.Get(name, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// setDate changes the date of a backup in the catalog of dstDir
+func setDate(t *testing.T, dstDir string, backupID int64, date time.Time) {
+	t.Helper()
+	c := newCatalog(dstDir)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if _, err := c.db.Exec("update bak_summary set date = ? where id = ?", date.Format(time.RFC3339), backupID); err != nil {
+		t.Fatal(err)
+	}
+}
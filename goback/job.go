@@ -0,0 +1,98 @@
+package goback
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Job backs up several source directories into the same destination.
+// Every source is a separate backup with its own baseline.
+type Job struct {
+	Name    string
+	srcDirs []string
+	dstDir  string
+	debug   bool
+	Options Options
+
+	Summaries []*Summary
+}
+
+func NewJob(name string, srcDirs []string, dstDir string, debug bool) *Job {
+	j := Job{
+		Name:    name,
+		srcDirs: srcDirs,
+		dstDir:  dstDir,
+		Options: defaultOptions(),
+		debug:   debug,
+	}
+	return &j
+}
+
+// Validate checks that no source directory is given twice
+func (j *Job) Validate() error {
+	if len(j.srcDirs) < 1 {
+		return fmt.Errorf("no source directory")
+	}
+	seen := make(map[string]bool)
+	for _, dir := range j.srcDirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			return fmt.Errorf("duplicate source directory: %s", dir)
+		}
+		seen[abs] = true
+	}
+	return nil
+}
+
+// Run backs up every source directory in order. A failed source does not stop the others.
+// If no source failed but some had failed files, a PartialError is returned.
+func (j *Job) Run() error {
+	if err := j.Validate(); err != nil {
+		return err
+	}
+
+	var failed int
+	var partial PartialError
+	for _, srcDir := range j.srcDirs {
+		err := j.backup(srcDir)
+		var pe *PartialError
+		if errors.As(err, &pe) {
+			log.Warnf("backup of %s completed with failures: %s", srcDir, err.Error())
+			partial.Failed += pe.Failed
+			continue
+		}
+		if err != nil {
+			log.Errorf("backup of %s failed: %s", srcDir, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sources failed", failed, len(j.srcDirs))
+	}
+	if partial.Failed > 0 {
+		return &partial
+	}
+	return nil
+}
+
+func (j *Job) backup(srcDir string) error {
+	b := NewBackup(srcDir, j.dstDir, j.debug)
+	b.Options = j.Options
+	b.Options.Job = j.Name
+
+	if err := b.Initialize(); err != nil {
+		return err
+	}
+	err := b.Start()
+	if cerr := b.Close(); cerr != nil && (err == nil || IsPartial(err)) {
+		err = cerr
+	}
+	j.Summaries = append(j.Summaries, b.S)
+	return err
+}
@@ -0,0 +1,111 @@
+package goback
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Every source of a job keeps its own baseline and summary: a change in one
+// source, or a source added to the job, leaves the others unchanged
+func TestJobSourcesKeepBaselines(t *testing.T) {
+	src1, src2, src3, dstDir := t.TempDir(), t.TempDir(), t.TempDir(), t.TempDir()
+	writeFiles(t, src1, map[string]string{"a.txt": "a", "b.txt": "b"})
+	writeFiles(t, src2, map[string]string{"c.txt": "c"})
+	writeFiles(t, src3, map[string]string{"d.txt": "d"})
+
+	runs := []struct {
+		srcDirs []string
+		changes map[string]map[string]string
+		added   map[string]uint32 // Files added per source
+		changed map[string]uint32 // Files modified per source
+	}{
+		{[]string{src1, src2}, nil, map[string]uint32{src1: 2, src2: 1}, nil},
+		{[]string{src1, src2}, map[string]map[string]string{src1: {"a.txt": "changed"}}, nil, map[string]uint32{src1: 1}},
+		{[]string{src1, src2, src3}, map[string]map[string]string{src2: {"e.txt": "new"}}, map[string]uint32{src2: 1, src3: 1}, nil},
+		{[]string{src3, src1}, nil, nil, nil},
+	}
+	for i, run := range runs {
+		for srcDir, files := range run.changes {
+			writeFiles(t, srcDir, files)
+		}
+		j := NewJob("job", run.srcDirs, dstDir, false)
+		if err := j.Run(); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		if len(j.Summaries) != len(run.srcDirs) {
+			t.Fatalf("run %d: %d summaries, want %d", i+1, len(j.Summaries), len(run.srcDirs))
+		}
+		for k, s := range j.Summaries {
+			srcDir := run.srcDirs[k]
+			if s.SrcDir != srcDir || s.Job != "job" {
+				t.Errorf("run %d: summary of job %q and %s, want %s", i+1, s.Job, s.SrcDir, srcDir)
+			}
+			if s.BackupAdded != run.added[srcDir] || s.BackupModified != run.changed[srcDir] || s.BackupDeleted > 0 {
+				t.Errorf("run %d, %s: %d added, %d modified, %d deleted, want %d added, %d modified",
+					i+1, srcDir, s.BackupAdded, s.BackupModified, s.BackupDeleted, run.added[srcDir], run.changed[srcDir])
+			}
+			if got, want := restoreTree(t, dstDir, s.ID), readTree(t, srcDir); !reflect.DeepEqual(got, want) {
+				t.Errorf("run %d, %s: restored %v, want %v", i+1, srcDir, got, want)
+			}
+		}
+	}
+}
+
+// A source which fails does not stop the other sources of the job, nor
+// touch their baselines
+func TestJobSourceFails(t *testing.T) {
+	good, dstDir := t.TempDir(), t.TempDir()
+	bad := filepath.Join(t.TempDir(), "not yet")
+	writeFiles(t, good, map[string]string{"a.txt": "a"})
+
+	j := NewJob("job", []string{bad, good}, dstDir, false)
+	err := j.Run()
+	if err == nil || IsPartial(err) {
+		t.Fatalf("job with a missing source: %v", err)
+	}
+	if len(j.Summaries) != 1 || j.Summaries[0].SrcDir != good || j.Summaries[0].BackupAdded != 1 {
+		t.Fatalf("summaries %+v, want one of %s", j.Summaries, good)
+	}
+
+	writeFiles(t, bad, map[string]string{"b.txt": "b"})
+	writeFiles(t, good, map[string]string{"c.txt": "c"})
+	j = NewJob("job", []string{bad, good}, dstDir, false)
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for k, added := range []uint32{1, 1} {
+		s := j.Summaries[k]
+		if s.BackupAdded != added || s.BackupModified+s.BackupDeleted > 0 {
+			t.Errorf("%s: %d added, %d modified, %d deleted, want %d added", s.SrcDir, s.BackupAdded, s.BackupModified, s.BackupDeleted, added)
+		}
+		if got, want := restoreTree(t, dstDir, s.ID), readTree(t, s.SrcDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: restored %v, want %v", s.SrcDir, got, want)
+		}
+	}
+
+	// A source which cannot be read fails after its backup has begun; root reads anything
+	if os.Geteuid() == 0 {
+		return
+	}
+	writeFiles(t, good, map[string]string{"d.txt": "d"})
+	if err := os.Chmod(bad, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(bad, 0755)
+	j = NewJob("job", []string{bad, good}, dstDir, false)
+	if err := j.Run(); err == nil || IsPartial(err) {
+		t.Fatalf("job with an unreadable source: %v", err)
+	}
+	os.Chmod(bad, 0755)
+	j = NewJob("job", []string{bad, good}, dstDir, false)
+	if err := j.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range j.Summaries {
+		if s.BackupAdded+s.BackupModified+s.BackupDeleted > 0 {
+			t.Errorf("%s: %d added, %d modified, %d deleted after the failed run", s.SrcDir, s.BackupAdded, s.BackupModified, s.BackupDeleted)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package goback
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A journal records the files copied by a running backup. It is kept next to
+// the temporary backup directory, so that a backup interrupted by a crash can be
+// resumed without copying the files again.
+const journalExt = ".journal"
+
+type journalHeader struct {
+	Job      string    `json:"job"`
+	SrcDir   string    `json:"src_dir"`
+	Date     time.Time `json:"date"`
+	Dedup    bool      `json:"dedup"`
+	Checksum bool      `json:"checksum"`
+	Excludes []string  `json:"excludes"`
+
+	Compression      string   `json:"compression,omitempty"`
+	CompressionLevel int      `json:"compression_level,omitempty"`
+	SkipCompress     []string `json:"skip_compress,omitempty"`
+	Archive          string   `json:"archive,omitempty"`
+	Snapshot         bool     `json:"snapshot,omitempty"`
+}
+
+type journalEntry struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	Hash      string    `json:"hash,omitempty"`
+	Codec     string    `json:"codec,omitempty"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	Chunks    []Chunk   `json:"chunks,omitempty"`
+}
+
+type journal struct {
+	path string
+	f    *os.File
+	mu   sync.Mutex
+}
+
+func journalPath(tempDir string) string {
+	return tempDir + journalExt
+}
+
+// createJournal starts the journal of a new backup
+func createJournal(tempDir string, h journalHeader) (*journal, error) {
+	j, err := openJournal(tempDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.write(h); err != nil {
+		j.close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// openJournal opens the journal of a backup for appending
+func openJournal(tempDir string) (*journal, error) {
+	path := journalPath(tempDir)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{
+		path: path,
+		f:    f,
+	}, nil
+}
+
+// add records a copied file
+func (j *journal) add(f *File) error {
+	return j.write(journalEntry{
+		Path:      f.Path,
+		Size:      f.Size,
+		ModTime:   f.ModTime,
+		Hash:      f.Hash,
+		Codec:     f.Codec,
+		Encrypted: f.Encrypted,
+		Chunks:    f.Chunks,
+	})
+}
+
+// write appends a line with a single write, so that a crash leaves at most the last line
+// incomplete, and flushes it to disk before the backup goes on
+func (j *journal) write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+// remove deletes the journal of a finished backup
+func (j *journal) remove() error {
+	if j == nil {
+		return nil
+	}
+	j.close()
+	return os.Remove(j.path)
+}
+
+// readJournal returns the header and the copied files of a journal.
+// An incomplete last line is ignored.
+func readJournal(tempDir string) (*journalHeader, map[string]*journalEntry, error) {
+	f, err := os.Open(journalPath(tempDir))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var header *journalHeader
+	entries := make(map[string]*journalEntry)
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if header == nil {
+			header = &journalHeader{}
+			if err := json.Unmarshal(line, header); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		e := &journalEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, nil, err
+		}
+		entries[e.Path] = e
+	}
+	if header == nil {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return header, entries, nil
+}
+
+// interruptedRun is a temporary backup directory left by a backup which did not finish
+type interruptedRun struct {
+	Dir    string
+	Header *journalHeader // Nil if the journal is unreadable
+	Copied int
+}
+
+// findInterrupted returns the temporary backup directories in dstDir which have a journal.
+// Other directories, whatever their names, are not touched.
+// The caller must hold the lock of dstDir, otherwise running backups are returned as well.
+func findInterrupted(dstDir string) ([]*interruptedRun, error) {
+	files, err := filepath.Glob(filepath.Join(dstDir, "bak*"+journalExt))
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*interruptedRun, 0)
+	for _, file := range files {
+		dir := strings.TrimSuffix(file, journalExt)
+		fi, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			// A stale journal
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+
+		run := &interruptedRun{Dir: dir}
+		header, entries, err := readJournal(dir)
+		if err == nil {
+			run.Header = header
+			run.Copied = len(entries)
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+// removeStaleJournals deletes journals whose temporary directory is gone.
+// They are left when a backup stops after renaming its directory.
+func removeStaleJournals(dstDir string) error {
+	files, err := filepath.Glob(filepath.Join(dstDir, "bak*"+journalExt))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if _, err := os.Stat(strings.TrimSuffix(file, journalExt)); os.IsNotExist(err) {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *interruptedRun) String() string {
+	if r.Header == nil {
+		return r.Dir + " (journal unreadable)"
+	}
+	name := r.Header.SrcDir
+	if r.Header.Job != "" {
+		name = r.Header.Job + ":" + name
+	}
+	return name + " started at " + r.Header.Date.Format(time.RFC3339) + " in " + r.Dir
+}
+
+// rollback deletes the copies, the temporary directory and the journal of an interrupted backup,
+// and the files it was storing when it was interrupted. Chunks it stored are left to prune.
+func (r *interruptedRun) rollback(storage Storage) error {
+	if err := deletePrefix(storage, filepath.Base(r.Dir)); err != nil {
+		return err
+	}
+	if err := deletePrefix(storage, putTempDir); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(r.Dir); err != nil {
+		return err
+	}
+	err := os.Remove(journalPath(r.Dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
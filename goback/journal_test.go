@@ -0,0 +1,81 @@
+package goback
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// appendJournal appends raw data to the journal of a backup
+func appendJournal(t *testing.T, tempDir, data string) {
+	t.Helper()
+	f, err := os.OpenFile(journalPath(tempDir), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadJournal(t *testing.T) {
+	tempDir := filepath.Join(t.TempDir(), "bak1")
+	header := journalHeader{
+		Job:      "home",
+		SrcDir:   "/data",
+		Date:     time.Date(2026, 9, 1, 0, 5, 0, 0, time.UTC),
+		Excludes: []string{"*.tmp"},
+	}
+	j, err := createJournal(tempDir, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2026, 8, 31, 12, 0, 0, 0, time.UTC)
+	files := []*File{
+		{Path: "/data/a.txt", Size: 1, ModTime: modTime},
+		{Path: "/data/b.txt", Size: 2, ModTime: modTime, Codec: CodecZstd},
+		{Path: "/data/a.txt", Size: 3, ModTime: modTime}, // Copied again
+	}
+	for _, f := range files {
+		if err := j.add(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.close()
+
+	// A line cut short by a crash
+	appendJournal(t, tempDir, `{"path":"/data/c.txt","si`)
+
+	h, entries, err := readJournal(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*h, header) {
+		t.Errorf("header %+v, want %+v", *h, header)
+	}
+	if len(entries) != 2 || entries["/data/a.txt"].Size != 3 || entries["/data/b.txt"].Codec != CodecZstd {
+		t.Errorf("entries: %v", entries)
+	}
+
+	// A broken line before the last is an error
+	appendJournal(t, tempDir, "\n"+`{"path":"/data/d.txt"}`+"\n")
+	if _, _, err := readJournal(tempDir); err == nil {
+		t.Error("broken line read")
+	}
+
+	// A journal without a complete header
+	empty := filepath.Join(t.TempDir(), "bak2")
+	if err := ioutil.WriteFile(journalPath(empty), []byte(`{"job":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readJournal(empty); err != io.ErrUnexpectedEOF {
+		t.Errorf("journal without header: %v", err)
+	}
+}
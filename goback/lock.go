@@ -0,0 +1,166 @@
+package goback
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	lockFileName = "goback.lock"
+	lockRefresh  = time.Minute      // The holder touches the lock file this often
+	lockStale    = 10 * time.Minute // A lock file not touched for this long is stale
+)
+
+// lockRetry is how often a waiting backup tries again; tests shorten it
+var lockRetry = 5 * time.Second
+
+type lockInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+}
+
+// lock is an exclusive advisory lock on a destination directory
+type lock struct {
+	path string
+	info lockInfo
+	done chan struct{}
+}
+
+// acquireLock locks dstDir. If it is locked by a live process, it returns an error
+// or, when wait is set, blocks until the lock is released.
+func acquireLock(dstDir string, wait bool) (*lock, error) {
+	hostname, _ := os.Hostname()
+	l := &lock{
+		path: filepath.Join(dstDir, lockFileName),
+		info: lockInfo{
+			PID:      os.Getpid(),
+			Hostname: hostname,
+		},
+		done: make(chan struct{}),
+	}
+
+	waiting := false
+	for {
+		err := l.create()
+		if err == nil {
+			go l.refresh()
+			return l, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		holder, stale, err := readLock(l.path)
+		if err != nil {
+			return nil, err
+		}
+		if stale {
+			log.Warnf("removing stale lock of pid %d on %s (since %s)", holder.PID, holder.Hostname, holder.Created.Format(time.RFC3339))
+			if err := removeLock(l.path, holder); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		msg := fmt.Sprintf("%s is locked by pid %d on %s since %s", dstDir, holder.PID, holder.Hostname, holder.Created.Format(time.RFC3339))
+		if !wait {
+			return nil, fmt.Errorf("%s; another backup may be running", msg)
+		}
+		if !waiting {
+			log.Infof("%s; waiting", msg)
+			waiting = true
+		}
+		time.Sleep(lockRetry)
+	}
+}
+
+func (l *lock) create() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	l.info.Created = time.Now()
+	err = json.NewEncoder(f).Encode(l.info)
+	if err != nil {
+		f.Close()
+		os.Remove(l.path)
+		return err
+	}
+	return f.Close()
+}
+
+// refresh touches the lock file until it is released
+func (l *lock) refresh() {
+	ticker := time.NewTicker(lockRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := os.Chtimes(l.path, now, now); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (l *lock) release() error {
+	if l == nil {
+		return nil
+	}
+	close(l.done)
+	return os.Remove(l.path)
+}
+
+// readLock returns the holder of a lock file and whether the lock is stale.
+// A lock is stale if its process is gone on this host or it has not been touched for a while.
+func readLock(path string) (lockInfo, bool, error) {
+	var info lockInfo
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return info, false, nil
+	}
+	if err != nil {
+		return info, false, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return info, false, err
+	}
+
+	// A lock file being written or broken is stale only when old
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, time.Since(fi.ModTime()) > lockStale, nil
+	}
+
+	hostname, _ := os.Hostname()
+	if info.Hostname == hostname && !processAlive(info.PID) {
+		return info, true, nil
+	}
+	return info, time.Since(fi.ModTime()) > lockStale, nil
+}
+
+// removeLock removes a stale lock file unless another process has replaced it in the meantime
+func removeLock(path string, holder lockInfo) error {
+	current, _, err := readLock(path)
+	if err != nil {
+		return err
+	}
+	if current != holder {
+		return nil
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package goback
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeLock leaves a lock file of another process, last touched at modTime
+func writeLock(t *testing.T, dir string, info lockInfo, modTime time.Time) {
+	t.Helper()
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, lockFileName)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPID returns the ID of a process which has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestLockHeld(t *testing.T) {
+	dir := t.TempDir()
+	l, err := acquireLock(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(dir, false); err == nil {
+		t.Fatal("locked twice")
+	}
+	if err := l.release(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = acquireLock(dir, false)
+	if err != nil {
+		t.Fatalf("after release: %s", err)
+	}
+	l.release()
+}
+
+func TestLockStale(t *testing.T) {
+	hostname, _ := os.Hostname()
+	old := time.Now().Add(-lockStale - time.Minute)
+	tests := []struct {
+		name    string
+		info    lockInfo
+		modTime time.Time
+		stale   bool
+	}{
+		{"live process", lockInfo{PID: os.Getpid(), Hostname: hostname}, time.Now(), false},
+		{"dead process", lockInfo{PID: deadPID(t), Hostname: hostname}, time.Now(), true},
+		{"not touched", lockInfo{PID: os.Getpid(), Hostname: hostname}, old, true},
+		{"other host", lockInfo{PID: deadPID(t), Hostname: hostname + "-other"}, time.Now(), false},
+		{"other host, not touched", lockInfo{PID: os.Getpid(), Hostname: hostname + "-other"}, old, true},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		writeLock(t, dir, tt.info, tt.modTime)
+		l, err := acquireLock(dir, false)
+		if (err == nil) != tt.stale {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		l.release()
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	defer func(retry time.Duration) {
+		lockRetry = retry
+	}(lockRetry)
+	lockRetry = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	held, err := acquireLock(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan error, 1)
+	go func() {
+		l, err := acquireLock(dir, true)
+		if err == nil {
+			err = l.release()
+		}
+		acquired <- err
+	}()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("acquired while held: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	held.release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not acquired after release")
+	}
+}
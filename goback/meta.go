@@ -0,0 +1,137 @@
+package goback
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mode bits restored with chmod
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// newFileInfo returns a file with the metadata of f. Symlinks keep their target.
+func newFileInfo(path string, f os.FileInfo) *File {
+	fi := newFile(path, f.Size(), f.ModTime())
+	fi.Mode = f.Mode()
+	fi.Uid, fi.Gid = fileOwner(f)
+	if f.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			log.Error(err)
+		}
+		fi.Link = link
+	}
+	return fi
+}
+
+// backedUp returns true if a file of the mode is backed up. Devices, sockets and pipes are not.
+func backedUp(mode os.FileMode) bool {
+	return mode.IsRegular() || mode&os.ModeSymlink != 0
+}
+
+// metadataChanged compares mode, owner, symlink target and extended attributes. Baselines
+// written before metadata was recorded have no mode and are not compared. Extended
+// attributes are compared only when both checksums are known.
+func metadataChanged(last, fi *File) bool {
+	if last.Mode == 0 {
+		return false
+	}
+	if last.XattrHash != "" && fi.XattrHash != "" && last.XattrHash != fi.XattrHash {
+		return true
+	}
+	return last.Mode != fi.Mode || last.Uid != fi.Uid || last.Gid != fi.Gid || last.Link != fi.Link
+}
+
+// readFileXattrs reads the extended attributes of a file and their checksum
+func readFileXattrs(fi *File) {
+	xattrs, err := readXattrs(fi.Path)
+	if err != nil {
+		log.Debugf("%s: %s", fi.Path, err.Error())
+		return
+	}
+	fi.Xattrs = xattrs
+	fi.XattrHash = hashXattrs(xattrs)
+}
+
+// hashXattrs returns the SHA-256 checksum of extended attributes in hex. Files
+// without attributes have a checksum too, so that an empty one means unknown.
+func hashXattrs(xattrs map[string][]byte) string {
+	sum := sha256.Sum256([]byte(encodeXattrs(xattrs)))
+	return hex.EncodeToString(sum[:])
+}
+
+func encodeXattrs(xattrs map[string][]byte) string {
+	if len(xattrs) < 1 {
+		return ""
+	}
+	data, _ := json.Marshal(xattrs)
+	return string(data)
+}
+
+func decodeXattrs(s string) map[string][]byte {
+	if s == "" {
+		return nil
+	}
+	var xattrs map[string][]byte
+	if err := json.Unmarshal([]byte(s), &xattrs); err != nil {
+		log.Error(err)
+	}
+	return xattrs
+}
+
+// restoreMetadata applies the owner, mode, extended attributes and modification time of a restored file.
+// Owners are restored only when running as root; attributes that cannot be set are logged.
+func restoreMetadata(path string, mode os.FileMode, uid, gid int, xattrs map[string][]byte, modTime time.Time) error {
+	if err := lchown(path, uid, gid); err != nil {
+		log.Warn(err)
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode&modeBits); err != nil {
+			return err
+		}
+	}
+	for name, value := range xattrs {
+		if err := setXattr(path, name, value); err != nil {
+			log.Warnf("%s: %s: %s", path, name, err.Error())
+		}
+	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// restoreDirs applies the metadata of directories, deepest first so that
+// restoring a directory does not change the modification time of its parent
+func restoreDirs(dirs []*File, dstPath func(string) string) {
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i].Path) > len(dirs[j].Path)
+	})
+	for _, d := range dirs {
+		dst := dstPath(d.Path)
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			log.Error(err)
+			continue
+		}
+		if err := restoreMetadata(dst, d.Mode, d.Uid, d.Gid, d.Xattrs, d.ModTime); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// restoreSymlink creates a symlink in place of whatever is at dst
+func restoreSymlink(link, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(link, dst)
+}
@@ -0,0 +1,54 @@
+package goback
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A change of extended attributes or mode alone makes a file modified, and the restore has it
+func TestMetadataChanged(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"})
+	a, b := filepath.Join(srcDir, "a.txt"), filepath.Join(srcDir, "b.txt")
+	if err := setXattr(a, "user.goback", []byte("first")); err != nil {
+		t.Skipf("extended attributes not supported: %v", err)
+	}
+	if _, err := runBackup(t, srcDir, dstDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := setXattr(a, "user.goback", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupModified != 2 {
+		t.Fatalf("%d files modified", s.BackupModified)
+	}
+
+	target := t.TempDir()
+	restoreInto(t, dstDir, s.ID, target)
+	xattrs, err := readXattrs(filepath.Join(target, "a.txt"))
+	if err != nil || string(xattrs["user.goback"]) != "second" {
+		t.Errorf("restored attributes %v: %v", xattrs, err)
+	}
+	if f, err := os.Stat(filepath.Join(target, "b.txt")); err != nil {
+		t.Error(err)
+	} else if f.Mode().Perm() != 0600 {
+		t.Errorf("restored mode %v", f.Mode())
+	}
+
+	s, err = runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupModified != 0 {
+		t.Errorf("%d unchanged files modified", s.BackupModified)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package goback
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileOwner(f os.FileInfo) (int, int) {
+	if st, ok := f.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return 0, 0
+}
+
+// lchown changes the owner of a file or a symlink. Only root can give files away.
+func lchown(path string, uid, gid int) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, uid, gid)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package goback
+
+import "os"
+
+// Windows has no numeric owners
+func fileOwner(f os.FileInfo) (int, int) {
+	return 0, 0
+}
+
+func lchown(path string, uid, gid int) error {
+	return nil
+}
@@ -0,0 +1,189 @@
+package goback
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// moveKey is what a moved file keeps: its size and mtime
+type moveKey struct {
+	size    int64
+	modTime int64
+}
+
+func newMoveKey(f *File) moveKey {
+	return moveKey{f.Size, f.ModTime.Unix()}
+}
+
+// moveIndex holds the files of the last backup by size and mtime, and the added
+// files which may have been moved from one of them
+type moveIndex struct {
+	mu      sync.Mutex
+	origin  map[moveKey][]*File
+	pending []*File
+}
+
+func newMoveIndex(originMap *sync.Map) *moveIndex {
+	m := &moveIndex{origin: make(map[moveKey][]*File)}
+	originMap.Range(func(key, value interface{}) bool {
+		f := value.(*File)
+		k := newMoveKey(f)
+		m.origin[k] = append(m.origin[k], f)
+		return true
+	})
+	return m
+}
+
+// hold keeps an added file until the walk is done if a file of the last backup has
+// its size and mtime and has not been seen by the walk yet. Whether that file is gone
+// is known only then. Empty files are not held, as copying them costs nothing; nor are
+// copies of files already seen, like those of a tree copied by cp -a.
+func (m *moveIndex) hold(fi *File, originMap *sync.Map) bool {
+	if fi.Size == 0 {
+		return false
+	}
+	for _, old := range m.origin[newMoveKey(fi)] {
+		if _, ok := originMap.Load(old.Path); ok {
+			m.mu.Lock()
+			m.pending = append(m.pending, fi)
+			m.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// resolveMoves records the held files as moved from files of the last backup which
+// are gone from the source. The others are stored as added by the workers.
+func (b *Backup) resolveMoves(originMap *sync.Map) {
+	pending := b.moves.pending
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].Path < pending[j].Path
+	})
+
+	added := make(chan *File, b.Options.Workers*2)
+	wg := sync.WaitGroup{}
+	for i := 0; i < b.Options.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fi := range added {
+				b.storeAdded(fi)
+			}
+		}()
+	}
+	for _, fi := range pending {
+		old := b.findMoved(fi, originMap)
+		if old == nil {
+			added <- fi
+			continue
+		}
+		originMap.Delete(old.Path)
+		b.storeMoved(fi, old)
+	}
+	close(added)
+	wg.Wait()
+	b.moves.pending = nil
+}
+
+// findMoved returns the file of the last backup a file was moved from, or nil.
+// Checksums are compared when both are known. A file whose data cannot be restored
+// from its old path is not a move, so that it is copied. Of several gone files with
+// the size and mtime, the one of the same name is taken, unless the checksums show
+// that they all hold the same data; with no such file, the file is taken as added.
+func (b *Backup) findMoved(fi *File, originMap *sync.Map) *File {
+	found := make([]*File, 0)
+	sameData := fi.Hash != ""
+	for _, old := range b.moves.origin[newMoveKey(fi)] {
+		if _, ok := originMap.Load(old.Path); !ok {
+			continue
+		}
+		if old.Mode&os.ModeSymlink != fi.Mode&os.ModeSymlink || old.Link != fi.Link {
+			continue
+		}
+		if old.Hash != "" && fi.Hash != "" && old.Hash != fi.Hash {
+			continue
+		}
+		if fi.Mode&os.ModeSymlink == 0 && !b.hasCopy(old.Path) {
+			continue
+		}
+		found = append(found, old)
+		sameData = sameData && old.Hash != ""
+	}
+	if len(found) == 1 || (len(found) > 1 && sameData) {
+		return found[0]
+	}
+
+	var moved *File
+	for _, old := range found {
+		if filepath.Base(old.Path) != filepath.Base(fi.Path) {
+			continue
+		}
+		if moved != nil {
+			return nil
+		}
+		moved = old
+	}
+	return moved
+}
+
+// storeMoved records a moved file. Its data is not copied again.
+func (b *Backup) storeMoved(fi, old *File) {
+	log.Debugf("moved: %s -> %s", old.Path, fi.Path)
+	fi.State = FileMoved
+	fi.OldPath = old.Path
+	b.S.BackupMoved++
+	if !b.Options.DryRun && b.snapshot != nil {
+		if err := b.linkMoved(fi); err != nil {
+			atomic.AddUint32(&b.S.BackupFailure, 1)
+			log.Error(err)
+			fi.Message = err.Error()
+			fi.State = -FileMoved
+			return
+		}
+	}
+	atomic.AddUint32(&b.S.BackupSuccess, 1)
+}
+
+// hasCopy tells whether the last logged version of a path has data to restore,
+// following earlier moves. Older versions copied nothing in the initial run.
+func (b *Backup) hasCopy(path string) bool {
+	var id int64 = 1<<63 - 1
+	for {
+		var state int
+		err := b.dbLog.QueryRow(`
+			select t1.id, t1.state, t1.old_path
+			from bak_log t1 join bak_summary t2 on t2.id = t1.id
+			where t2.job = ? and t2.src_dir = ? and t2.state > 0 and t1.path = ? and t1.id < ?
+			order by t1.id desc
+			limit 1
+		`, b.S.Job, b.srcDir, path, id).Scan(&id, &state, &path)
+		if err != nil {
+			return false
+		}
+		if state != FileMoved {
+			return state == FileAdded || state == FileModified
+		}
+	}
+}
+
+// movedFrom returns the version holding the data of a moved file, following earlier moves
+func (c *catalog) movedFrom(v *Version) (*Version, error) {
+	for v.State == FileMoved {
+		versions, err := c.queryVersions("t1.id < ? and t2.job = ? and t2.src_dir = ? and t2.state > 0 and t1.path = ?", v.ID, v.Job, v.SrcDir, v.OldPath)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) < 1 || versions[0].State < 0 || versions[0].State == FileDeleted {
+			return nil, fmt.Errorf("no copy of %s, moved to %s", v.OldPath, v.Path)
+		}
+		v = versions[0]
+	}
+	return v, nil
+}
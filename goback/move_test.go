@@ -0,0 +1,120 @@
+package goback
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A moved file is logged with its old path and restored from the copy of the old path,
+// also after it is moved again
+func TestMoveRestore(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"a/report.txt": "quarterly report",
+		"other.txt":    "other",
+	})
+	if _, err := runBackup(t, srcDir, dstDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	trees := make(map[int64]map[string]string)
+	for _, move := range [][2]string{{"a/report.txt", "b/report.txt"}, {"b/report.txt", "c/renamed.txt"}} {
+		moveFile(t, srcDir, move[0], move[1])
+		s, err := runBackup(t, srcDir, dstDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.BackupMoved != 1 || s.BackupAdded+s.BackupDeleted > 0 || s.BackupSize > 0 {
+			t.Errorf("%s -> %s: %d moved, %d added, %d deleted, %d bytes stored",
+				move[0], move[1], s.BackupMoved, s.BackupAdded, s.BackupDeleted, s.BackupSize)
+		}
+		versions := loggedVersions(t, dstDir, s.ID)
+		if len(versions) != 1 {
+			t.Fatalf("%s -> %s: %d files logged", move[0], move[1], len(versions))
+		}
+		v := versions[0]
+		if v.State != FileMoved || v.Path != filepath.Join(srcDir, move[1]) || v.OldPath != filepath.Join(srcDir, move[0]) {
+			t.Errorf("logged %s %s from %s", StateName(v.State), v.Path, v.OldPath)
+		}
+		if _, err := os.Stat(filepath.Join(s.DstDir, move[1])); !os.IsNotExist(err) {
+			t.Errorf("%s copied: %v", move[1], err)
+		}
+		trees[s.ID] = readTree(t, srcDir)
+	}
+
+	for id, want := range trees {
+		if got := restoreTree(t, dstDir, id); !reflect.DeepEqual(got, want) {
+			t.Errorf("backup_id=%d: restored %v, want %v", id, got, want)
+		}
+	}
+
+	// The moved file alone
+	r := NewRestore(dstDir, false)
+	if err := r.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	target := t.TempDir()
+	if err := r.RestorePath(filepath.Join(srcDir, "c", "renamed.txt"), time.Now(), 0, target); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, target); got["renamed.txt"] != "quarterly report" {
+		t.Errorf("restored %v", got)
+	}
+}
+
+// Of several gone files with the size and mtime of an added file, none is taken
+// unless one has its name
+func TestMoveAmbiguous(t *testing.T) {
+	tests := []struct {
+		added   string
+		data    string
+		oldPath string
+	}{
+		{"z/3.txt", "two", ""},
+		{"z/1.txt", "one", "x/1.txt"},
+	}
+	for _, tt := range tests {
+		srcDir, dstDir := t.TempDir(), t.TempDir()
+		writeFiles(t, srcDir, map[string]string{"x/1.txt": "one", "y/2.txt": "two"})
+		modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+		setModTime := func(name string) {
+			if err := os.Chtimes(filepath.Join(srcDir, filepath.FromSlash(name)), modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setModTime("x/1.txt")
+		setModTime("y/2.txt")
+		if _, err := runBackup(t, srcDir, dstDir, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.RemoveAll(filepath.Join(srcDir, "x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.RemoveAll(filepath.Join(srcDir, "y")); err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, srcDir, map[string]string{tt.added: tt.data})
+		setModTime(tt.added)
+		s, err := runBackup(t, srcDir, dstDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var oldPath string
+		for _, v := range loggedVersions(t, dstDir, s.ID) {
+			if v.State == FileMoved {
+				oldPath, _ = filepath.Rel(srcDir, v.OldPath)
+			}
+		}
+		if filepath.ToSlash(oldPath) != tt.oldPath {
+			t.Errorf("%s: moved from %q, want %q", tt.added, oldPath, tt.oldPath)
+		}
+		if got, want := restoreTree(t, dstDir, s.ID), readTree(t, srcDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: restored %v, want %v", tt.added, got, want)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package goback
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// RetentionPolicy decides which backups are kept. Each rule keeps the newest backup
+// of that many most recent days, weeks, months or years; the newest backup is always kept.
+type RetentionPolicy struct {
+	Last    int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+}
+
+func (p RetentionPolicy) empty() bool {
+	return p.Last+p.Daily+p.Weekly+p.Monthly+p.Yearly < 1
+}
+
+// keep returns the IDs of the backups to keep. runs must be sorted newest first.
+// Pruned backups cannot be restored, so they are neither kept nor fill a rule; they
+// are pruned again, as copies kept for backups pruned since then are no longer needed.
+func (p RetentionPolicy) keep(all []*Summary) map[int64]bool {
+	runs := make([]*Summary, 0, len(all))
+	for _, s := range all {
+		if !s.Pruned {
+			runs = append(runs, s)
+		}
+	}
+
+	keep := make(map[int64]bool)
+	if len(runs) < 1 {
+		return keep
+	}
+	keep[runs[0].ID] = true
+
+	for i := 0; i < p.Last && i < len(runs); i++ {
+		keep[runs[i].ID] = true
+	}
+
+	apply := func(n int, period func(time.Time) string) {
+		var last string
+		for _, s := range runs {
+			if n < 1 {
+				return
+			}
+			key := period(s.Date.Local())
+			if key == last {
+				continue
+			}
+			last = key
+			keep[s.ID] = true
+			n--
+		}
+	}
+	apply(p.Daily, func(t time.Time) string {
+		return t.Format("20060102")
+	})
+	apply(p.Weekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-%02d", y, w)
+	})
+	apply(p.Monthly, func(t time.Time) string {
+		return t.Format("200601")
+	})
+	apply(p.Yearly, func(t time.Time) string {
+		return t.Format("2006")
+	})
+
+	return keep
+}
+
+type Prune struct {
+	*catalog
+	debug bool
+
+	Policy   RetentionPolicy
+	Jobs     []string // Prune only backups of these jobs; all if empty
+	DryRun   bool
+	WaitLock bool
+
+	lock *lock
+
+	Kept        uint32
+	Pruned      uint32
+	FilesKept   uint32
+	FilesPruned uint32
+	PrunedSize  uint64
+}
+
+func NewPrune(dstDir string, policy RetentionPolicy, debug bool) *Prune {
+	p := Prune{
+		catalog: newCatalog(dstDir),
+		Policy:  policy,
+		debug:   debug,
+	}
+	return &p
+}
+
+// Initialize
+func (p *Prune) Initialize() error {
+	if p.Policy.empty() {
+		return errors.New("no retention rule")
+	}
+
+	lock, err := acquireLock(p.dstDir, p.WaitLock)
+	if err != nil {
+		return err
+	}
+	p.lock = lock
+
+	if err := p.open(); err != nil {
+		p.lock.release()
+		return err
+	}
+
+	if p.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	return nil
+}
+
+// Prune deletes the stored copies of expired backups and marks them as pruned.
+// A copy that a kept backup still needs for restore is never deleted.
+func (p *Prune) Prune() error {
+	runs, err := p.getBackups()
+	if err != nil {
+		return err
+	}
+
+	// Backups of each source of a job are retained separately
+	type source struct {
+		job    string
+		srcDir string
+	}
+	bySource := make(map[source][]*Summary)
+	for _, s := range runs {
+		if !p.selected(s.Job) {
+			continue
+		}
+		key := source{s.Job, s.SrcDir}
+		bySource[key] = append(bySource[key], s)
+	}
+	for key, runs := range bySource {
+		if err := p.pruneSource(key.job, key.srcDir, runs); err != nil {
+			return err
+		}
+	}
+
+	if p.DryRun {
+		return nil
+	}
+	return p.collectChunks()
+}
+
+func (p *Prune) selected(job string) bool {
+	if len(p.Jobs) < 1 {
+		return true
+	}
+	for _, j := range p.Jobs {
+		if j == job {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Prune) pruneSource(job, srcDir string, runs []*Summary) error {
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].ID > runs[j].ID
+	})
+	keep := p.Policy.keep(runs)
+
+	versions, err := p.queryVersions("t2.job = ? and t2.src_dir = ?", job, srcDir)
+	if err != nil {
+		return err
+	}
+
+	needed := p.neededCopies(versions, keep)
+
+	for _, s := range runs {
+		if keep[s.ID] {
+			log.Debugf("keeping backup_id=%d (%s)", s.ID, s.Date.Format(time.RFC3339))
+			p.Kept++
+			continue
+		}
+
+		var kept, pruned uint32
+		for _, v := range versions {
+			if v.ID != s.ID || v.State < 0 || v.State == FileDeleted || v.State == FileMoved {
+				continue
+			}
+			if needed[v.ID][v.Path] {
+				kept++
+				continue
+			}
+			if err := p.pruneVersion(v); err != nil {
+				return err
+			}
+			pruned++
+			p.PrunedSize += uint64(v.Size)
+		}
+		p.FilesKept += kept
+		p.FilesPruned += pruned
+
+		if !s.Pruned {
+			p.Pruned++
+			log.WithFields(log.Fields{
+				"pruned": pruned,
+				"kept":   kept,
+			}).Infof("pruning backup_id=%d (%s)", s.ID, s.Date.Format(time.RFC3339))
+		}
+		if p.DryRun {
+			continue
+		}
+		if isArchive(s.Storage) {
+			// Members cannot be deleted; the archive goes when no kept backup needs it
+			if kept == 0 && s.DstDir != "" {
+				if err := p.storage.Delete(filepath.Base(s.DstDir)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		} else if s.DstDir != "" {
+			if s.Storage == StorageSnapshot {
+				if err := p.pruneSnapshot(s, needed[s.ID]); err != nil {
+					return err
+				}
+			}
+			removeEmptyDirs(s.DstDir)
+		}
+		if _, err := p.db.Exec("update bak_summary set pruned = 1 where id = ?", s.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// neededCopies returns the copies needed to restore the kept backups, by backup id and path,
+// in one pass over the versions of a source sorted by path and id. A version is needed if a
+// kept backup falls between it and the next event of its path; a move ends its old path, and
+// a failed copy leaves the path as it was. A moved file needs the copy of its old path.
+func (p *Prune) neededCopies(versions []*Version, keep map[int64]bool) map[int64]map[string]bool {
+	kept := make([]int64, 0, len(keep))
+	for id := range keep {
+		kept = append(kept, id)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return kept[i] < kept[j]
+	})
+
+	type event struct {
+		path string
+		id   int64
+		v    *Version // nil if the file was moved away
+	}
+	events := make([]event, 0, len(versions))
+	for _, v := range versions {
+		if v.State < 0 {
+			continue
+		}
+		events = append(events, event{v.Path, v.ID, v})
+		if v.State == FileMoved {
+			events = append(events, event{v.OldPath, v.ID, nil})
+		}
+	}
+	// A file added where another was moved away in the same backup is what the path holds
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].path != events[j].path {
+			return events[i].path < events[j].path
+		}
+		if events[i].id != events[j].id {
+			return events[i].id < events[j].id
+		}
+		return events[i].v == nil && events[j].v != nil
+	})
+
+	needed := make(map[int64]map[string]bool)
+	add := func(id int64, path string) {
+		if needed[id] == nil {
+			needed[id] = make(map[string]bool)
+		}
+		needed[id][path] = true
+	}
+	for i, e := range events {
+		if e.v == nil || e.v.State == FileDeleted {
+			continue
+		}
+		next := int64(math.MaxInt64)
+		if i+1 < len(events) && events[i+1].path == e.path {
+			next = events[i+1].id
+		}
+		n := sort.Search(len(kept), func(n int) bool {
+			return kept[n] >= e.id
+		})
+		if n == len(kept) || kept[n] >= next {
+			continue
+		}
+		add(e.id, e.path)
+
+		if e.v.State != FileMoved || e.v.Mode&os.ModeSymlink != 0 {
+			continue
+		}
+		src, err := p.movedFrom(e.v)
+		if err != nil {
+			log.Debug(err)
+			continue
+		}
+		add(src.ID, src.Path)
+	}
+	return needed
+}
+
+// pruneVersion deletes a stored copy. Chunks are released by dropping the manifest.
+func (p *Prune) pruneVersion(v *Version) error {
+	log.Debugf("pruned: [%d] %s", v.ID, v.Path)
+	if p.DryRun {
+		return nil
+	}
+
+	if v.Storage == StorageChunk {
+		_, err := p.db.Exec("delete from bak_chunk where id = ? and path = ?", v.ID, v.Path)
+		return err
+	}
+	if isArchive(v.Storage) {
+		return nil
+	}
+
+	err := p.storage.Delete(v.storageName())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// collectChunks deletes chunks no manifest refers to
+func (p *Prune) collectChunks() error {
+	rows, err := p.db.Query("select distinct hash from bak_chunk")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	used := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		used[hash] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Chunks stored by interrupted backups are needed to resume them
+	runs, err := findInterrupted(p.dstDir)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		_, entries, err := readJournal(r.Dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			for _, c := range e.Chunks {
+				used[c.Hash] = true
+			}
+		}
+	}
+
+	objects, err := p.storage.List(chunkDir + "/")
+	if err != nil {
+		return err
+	}
+	var count uint32
+	for _, o := range objects {
+		if used[path.Base(o.Name)] {
+			continue
+		}
+		if err := p.storage.Delete(o.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		count++
+	}
+	log.Infof("unused chunks deleted: %d", count)
+	return nil
+}
+
+func (p *Prune) getBackups() ([]*Summary, error) {
+	rows, err := p.db.Query("select id, date, job, src_dir, dst_dir, storage, pruned from bak_summary where state > 0 order by id desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*Summary, 0)
+	for rows.Next() {
+		var date string
+		s := newSummary(0, "")
+		if err := rows.Scan(&s.ID, &date, &s.Job, &s.SrcDir, &s.DstDir, &s.Storage, &s.Pruned); err != nil {
+			return nil, err
+		}
+		s.Date, _ = time.Parse(time.RFC3339, date)
+		runs = append(runs, s)
+	}
+	return runs, rows.Err()
+}
+
+func (p *Prune) Close() error {
+	log.WithFields(log.Fields{
+		"kept":   p.Kept,
+		"pruned": p.Pruned,
+	}).Infof("prune result")
+	log.WithFields(log.Fields{
+		"kept":   p.FilesKept,
+		"pruned": p.FilesPruned,
+	}).Infof("files of pruned backups")
+	log.Infof("pruned size: %d(%s)", p.PrunedSize, humanize.Bytes(p.PrunedSize))
+
+	if err := p.lock.release(); err != nil {
+		log.Error(err)
+	}
+	return p.close()
+}
+
+// removeEmptyDirs removes empty directories under dir, including dir itself
+func removeEmptyDirs(dir string) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, e.Name()))
+		}
+	}
+	os.Remove(dir)
+}
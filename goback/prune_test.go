@@ -0,0 +1,142 @@
+package goback
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Pruned backups neither are kept nor fill a rule
+func TestRetentionPolicyKeepPruned(t *testing.T) {
+	day := func(d, h int) time.Time {
+		return time.Date(2026, 9, d, h, 0, 0, 0, time.Local)
+	}
+	runs := []*Summary{
+		{ID: 6, Date: day(3, 12)},
+		{ID: 5, Date: day(2, 18), Pruned: true},
+		{ID: 4, Date: day(2, 12)},
+		{ID: 3, Date: day(1, 18), Pruned: true},
+		{ID: 2, Date: day(1, 12)},
+		{ID: 1, Date: day(1, 6)},
+	}
+
+	tests := []struct {
+		policy RetentionPolicy
+		want   []int64
+	}{
+		{RetentionPolicy{Last: 3}, []int64{6, 4, 2}},
+		{RetentionPolicy{Daily: 3}, []int64{6, 4, 2}},
+		{RetentionPolicy{Daily: 2}, []int64{6, 4}},
+		{RetentionPolicy{Monthly: 1}, []int64{6}},
+	}
+	for _, tt := range tests {
+		keep := tt.policy.keep(runs)
+		if len(keep) != len(tt.want) {
+			t.Errorf("%+v: kept %v, want %v", tt.policy, keep, tt.want)
+			continue
+		}
+		for _, id := range tt.want {
+			if !keep[id] {
+				t.Errorf("%+v: kept %v, want %v", tt.policy, keep, tt.want)
+			}
+		}
+	}
+}
+
+// Pruning keeps the copies that kept backups need: unchanged files stored by a
+// pruned backup, and the old paths of moved files
+func TestPruneKeepsNeededCopies(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"a.txt": "unchanged",
+		"b.txt": "first version",
+		"c.txt": "moved later",
+	})
+	first, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, srcDir, map[string]string{"b.txt": "second version"})
+	if err := os.Mkdir(filepath.Join(srcDir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(srcDir, "c.txt"), filepath.Join(srcDir, "d", "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.BackupModified != 1 || second.BackupMoved != 1 {
+		t.Fatalf("second backup: %d modified, %d moved", second.BackupModified, second.BackupMoved)
+	}
+
+	writeFiles(t, srcDir, map[string]string{"e.txt": "new"})
+	last, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPrune(dstDir, RetentionPolicy{Last: 1}, false)
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	err = p.Prune()
+	p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Pruned != 2 || p.FilesPruned != 1 {
+		t.Errorf("%d backups and %d files pruned, want 2 and 1", p.Pruned, p.FilesPruned)
+	}
+	if _, err := os.Stat(filepath.Join(first.DstDir, "b.txt")); !os.IsNotExist(err) {
+		t.Errorf("first version of b.txt not pruned: %v", err)
+	}
+
+	want := readTree(t, srcDir)
+	if got := restoreTree(t, dstDir, last.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+}
+
+// The copies needed by kept backups are those their restores use
+func TestNeededCopies(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	states := []int{FileAdded, FileModified, FileDeleted, -FileAdded, -FileModified}
+	var versions []*Version
+	for id := int64(40); id > 0; id-- {
+		for i := 0; i < 8; i++ {
+			if rnd.Intn(3) == 0 {
+				path := fmt.Sprintf("file%d", i)
+				versions = append(versions, &Version{ID: id, Path: path, State: states[rnd.Intn(len(states))]})
+			}
+		}
+	}
+	keep := map[int64]bool{1: true, 7: true, 8: true, 23: true, 40: true}
+
+	want := make(map[int64]map[string]bool)
+	for id := range keep {
+		older := make([]*Version, 0)
+		for _, v := range versions {
+			if v.ID <= id {
+				older = append(older, v)
+			}
+		}
+		latest, _ := latestVersions(older)
+		for _, v := range latest {
+			if want[v.ID] == nil {
+				want[v.ID] = make(map[string]bool)
+			}
+			want[v.ID][v.Path] = true
+		}
+	}
+	p := NewPrune(t.TempDir(), RetentionPolicy{}, false)
+	if got := p.neededCopies(versions, keep); !reflect.DeepEqual(got, want) {
+		t.Errorf("needed %v, want %v", got, want)
+	}
+}
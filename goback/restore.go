@@ -0,0 +1,368 @@
+package goback
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+type Restore struct {
+	*catalog
+	debug bool
+
+	Passphrase string // Required if the backup directory is encrypted
+	Job        string // Job and source of the path to restore; needed only if several hold it
+	SrcDir     string
+
+	Restored    uint32
+	Failed      uint32
+	Missing     uint32
+	RestoreSize uint64
+}
+
+func NewRestore(dstDir string, debug bool) *Restore {
+	r := Restore{
+		catalog: newCatalog(dstDir),
+		debug:   debug,
+	}
+	return &r
+}
+
+// Initialize
+func (r *Restore) Initialize() error {
+	if err := r.open(); err != nil {
+		return err
+	}
+	if err := r.unlock(r.Passphrase); err != nil {
+		r.close()
+		return err
+	}
+
+	if r.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	return nil
+}
+
+// Restore rebuilds the source tree as of the given backup into targetDir.
+// For every path the newest successful copy at or before backupID is used.
+// Files without a stored copy, which older versions left unchanged since the
+// initial run, are counted as missing.
+func (r *Restore) Restore(backupID int64, targetDir string) error {
+	target, err := r.getSummary(backupID)
+	if err != nil {
+		return err
+	}
+	if target.State < 0 {
+		return errors.New("backup failed and cannot be restored: " + target.Message)
+	}
+	if target.Pruned {
+		return fmt.Errorf("backup was pruned and cannot be restored: %d", target.ID)
+	}
+	log.Infof("restoring backup_id=%d (%s) of %s", target.ID, target.Date.Format(time.RFC3339), target.SrcDir)
+
+	versions, err := r.targetVersions(target.ID, target.Job, target.SrcDir)
+	if err != nil {
+		return err
+	}
+
+	dstPath := func(path string) string {
+		return filepath.Join(targetDir, relPath(target.SrcDir, path))
+	}
+	r.restoreLatest(versions, "", dstPath)
+
+	unstored, err := r.unstored(target.ID, target.Job, target.SrcDir)
+	if err != nil {
+		return err
+	}
+	for _, path := range unstored {
+		log.Errorf("never stored: %s", path)
+		r.Missing++
+	}
+	return r.restoreDirs(target.ID, target.Job, target.SrcDir, "", dstPath)
+}
+
+// RestorePath restores a single file or a subtree as it was at the given time.
+// If backupID is greater than zero, no version newer than that backup is used.
+// The last element of path is created under targetDir.
+func (r *Restore) RestorePath(path string, at time.Time, backupID int64, targetDir string) error {
+	path = filepath.Clean(path)
+	last, versions, err := r.pathVersions(path, at, backupID)
+	if err != nil {
+		return err
+	}
+	if len(versions) < 1 {
+		return fmt.Errorf("no backup of %s at %s", path, at.Format(time.RFC3339))
+	}
+	log.Infof("restoring %s as of %s from backup_id=%d (%s)", path, at.Format(time.RFC3339), last.ID, last.Date.Format(time.RFC3339))
+
+	parentDir := filepath.Dir(path)
+	dstPath := func(path string) string {
+		return filepath.Join(targetDir, relPath(parentDir, path))
+	}
+	r.restoreLatest(versions, path, dstPath)
+	return r.restoreDirs(last.ID, last.Job, last.SrcDir, path, dstPath)
+}
+
+// Versions returns the logged versions of a file or of every file under a directory,
+// newest first, taken at or before the given time and backup ID. Files moved away
+// from under path are included.
+func (r *Restore) Versions(path string, at time.Time, backupID int64) ([]*Version, error) {
+	_, versions, err := r.pathVersions(filepath.Clean(path), at, backupID)
+	return versions, err
+}
+
+// pathVersions returns the last backup of the source of path at or before the given
+// time and backup ID, and the versions of path up to it. Versions of failed backups
+// are left out, as are those of pruned backups unless they are the newest of a path:
+// a pruned backup keeps only the copies which later backups need.
+func (r *Restore) pathVersions(path string, at time.Time, backupID int64) (*Summary, []*Version, error) {
+	job, srcDir, err := r.source(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	last, err := r.getLastAt(job, srcDir, at, backupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if last.Pruned {
+		return nil, nil, fmt.Errorf("backup_id=%d (%s) of %s was pruned and cannot be restored; choose the time or ID of a kept backup",
+			last.ID, last.Date.Format(time.RFC3339), srcDir)
+	}
+
+	prefix := strings.TrimSuffix(path, string(os.PathSeparator)) + string(os.PathSeparator)
+	versions, err := r.queryVersions("t1.id <= ? and t2.job = ? and t2.src_dir = ? and t2.state > 0 and (t1.path = ? or substr(cast(t1.path as blob), 1, ?) = cast(? as blob) or t1.old_path = ? or substr(cast(t1.old_path as blob), 1, ?) = cast(? as blob))",
+		last.ID, job, srcDir, path, len(prefix), prefix, path, len(prefix), prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	kept := make([]*Version, 0, len(versions))
+	seen := make(map[string]bool)
+	for _, v := range versions {
+		if !v.Pruned || !seen[v.Path] {
+			kept = append(kept, v)
+		}
+		seen[v.Path] = true
+	}
+	return last, kept, nil
+}
+
+// source returns the job and the source directory whose backups hold path. A path
+// in the sources of several jobs, or in nested sources, needs Job or SrcDir to choose one.
+func (r *Restore) source(path string) (string, string, error) {
+	sources, err := r.getSources()
+	if err != nil {
+		return "", "", err
+	}
+	matched := make([]string, 0)
+	var job, srcDir string
+	for _, s := range sources {
+		if (r.Job != "" && s.Job != r.Job) || (r.SrcDir != "" && s.SrcDir != filepath.Clean(r.SrcDir)) || !underPath(path, s.SrcDir) {
+			continue
+		}
+		job, srcDir = s.Job, s.SrcDir
+		matched = append(matched, fmt.Sprintf("job=%q source=%s", s.Job, s.SrcDir))
+	}
+	if len(matched) < 1 {
+		return "", "", fmt.Errorf("no backed up source holds %s", path)
+	}
+	if len(matched) > 1 {
+		return "", "", fmt.Errorf("%s is in several backed up sources (%s); choose one by job or source", path, strings.Join(matched, ", "))
+	}
+	return job, srcDir, nil
+}
+
+// restoreLatest restores the newest usable version of every path in versions, which are sorted newest first.
+// If path is not empty, only the files under it are restored.
+func (r *Restore) restoreLatest(versions []*Version, path string, dstPath func(string) string) {
+	latest, failed := latestVersions(versions)
+	for _, v := range latest {
+		if path != "" && !underPath(v.Path, path) {
+			continue
+		}
+		dst := dstPath(v.Path)
+		if err := r.restoreVersion(v, dst); err != nil {
+			log.Error(err)
+			r.Failed++
+			continue
+		}
+		log.Debugf("restored: %s", dst)
+		r.Restored++
+		r.RestoreSize += uint64(v.Size)
+	}
+
+	for _, path := range failed {
+		log.Errorf("no usable copy: %s", path)
+		r.Missing++
+	}
+}
+
+// latestVersions returns the newest successful version of every path in versions, which are sorted newest first.
+// Paths deleted by then are skipped; paths which only have failed copies are returned as failed.
+// A directory which could not be read has no copy to miss; its files are logged on their own.
+func latestVersions(versions []*Version) ([]*Version, []string) {
+	latest := make([]*Version, 0)
+	done := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, v := range versions {
+		if v.State == FileMoved && !done[v.OldPath] {
+			// The old path is gone since the move
+			done[v.OldPath] = true
+			delete(failed, v.OldPath)
+		}
+		if done[v.Path] {
+			continue
+		}
+
+		if v.State == FileDeleted {
+			done[v.Path] = true
+			continue
+		}
+		if v.State < 0 && v.Mode.IsDir() {
+			done[v.Path] = true
+			continue
+		}
+		if v.State < 0 {
+			log.Debugf("copy failed in backup_id=%d, looking for an older copy: %s", v.ID, v.Path)
+			failed[v.Path] = true
+			continue
+		}
+
+		done[v.Path] = true
+		delete(failed, v.Path)
+		latest = append(latest, v)
+	}
+
+	paths := make([]string, 0, len(failed))
+	for path := range failed {
+		paths = append(paths, path)
+	}
+	return latest, paths
+}
+
+// unstored returns the paths of a source which existed at backupID but were never stored.
+// Older versions logged nothing in the initial run; a path whose first event is not its
+// addition was in that run, as was a path moved away before it has a version of its own.
+func (r *Restore) unstored(backupID int64, job, srcDir string) ([]string, error) {
+	first, movedAway, err := r.firstEvents(job, srcDir)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := r.originPaths(job, srcDir)
+	if err != nil {
+		return nil, err
+	}
+	for path := range first {
+		paths = append(paths, path)
+	}
+	for path := range movedAway {
+		paths = append(paths, path)
+	}
+
+	unstored := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+
+		v, logged := first[path]
+		away, moved := movedAway[path]
+		if (logged && v.ID <= backupID) || (moved && away <= backupID) {
+			continue // Logged at or before backupID
+		}
+		if logged && (!moved || v.ID < away) && (v.State == FileAdded || v.State == -FileAdded || v.State == FileMoved || v.State == -FileMoved) {
+			continue // Added after backupID
+		}
+		unstored = append(unstored, path)
+	}
+	sort.Strings(unstored)
+	return unstored, nil
+}
+
+// restoreDirs applies the metadata of the directories of a source as of a backup.
+// Backups taken before directories were recorded have none.
+func (r *Restore) restoreDirs(backupID int64, job, srcDir, path string, dstPath func(string) string) error {
+	dirs, err := r.getDirs(backupID, job, srcDir, path)
+	if err != nil {
+		return err
+	}
+	restoreDirs(dirs, dstPath)
+	return nil
+}
+
+func (r *Restore) Close() error {
+	log.WithFields(log.Fields{
+		"restored": r.Restored,
+		"failed":   r.Failed,
+		"missing":  r.Missing,
+	}).Infof("restore result")
+	log.Infof("restore size: %d(%s)", r.RestoreSize, humanize.Bytes(r.RestoreSize))
+
+	return r.close()
+}
+
+func (r *Restore) restoreVersion(v *Version, dst string) error {
+	if v.Mode&os.ModeSymlink != 0 {
+		if err := restoreSymlink(v.Link, dst); err != nil {
+			return err
+		}
+		return restoreMetadata(dst, v.Mode, v.Uid, v.Gid, nil, v.ModTime)
+	}
+
+	src := v
+	if v.State == FileMoved {
+		var err error
+		if src, err = r.movedFrom(v); err != nil {
+			return err
+		}
+	}
+	from, err := r.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	if err := restoreFile(from, dst); err != nil {
+		return err
+	}
+	return restoreMetadata(dst, v.Mode, v.Uid, v.Gid, v.Xattrs, v.ModTime)
+}
+
+func restoreFile(from io.Reader, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+	to, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(to, from)
+	if err != nil {
+		to.Close()
+		return err
+	}
+	return to.Close()
+}
+
+// underPath tells whether p is path or below it
+func underPath(p, path string) bool {
+	return p == path || strings.HasPrefix(p, strings.TrimSuffix(path, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
+// relPath returns the path relative to the source directory
+func relPath(srcDir, path string) string {
+	return path[len(srcDir):]
+}
@@ -0,0 +1,237 @@
+package goback
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every backup restores the tree it was taken of, through additions, changes,
+// deletions and moves
+func TestRestore(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	rnd := rand.New(rand.NewSource(1))
+	trees := make(map[int64]map[string]string)
+	size := 0
+	for run := 0; run < 8; run++ {
+		files := readTree(t, srcDir)
+		names := make([]string, 0, len(files)+10)
+		for i := 0; i < 10; i++ {
+			names = append(names, fmt.Sprintf("d%d/file%d.txt", i%3, i))
+		}
+		for name := range files {
+			if strings.HasPrefix(name, "moved/") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		changed := make(map[string]string)
+		for i, name := range names {
+			// Sizes differ, so that no change is taken for a move
+			size++
+			content := strings.Repeat("x", size)
+			_, exists := files[name]
+			switch rnd.Intn(4) {
+			case 0:
+				changed[name] = content
+			case 1:
+				if exists {
+					if err := os.Remove(filepath.Join(srcDir, name)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			case 2:
+				if exists {
+					moveFile(t, srcDir, name, fmt.Sprintf("moved/run%d/file%d.txt", run, i))
+				}
+			}
+		}
+		writeFiles(t, srcDir, changed)
+
+		s, err := runBackup(t, srcDir, dstDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trees[s.ID] = readTree(t, srcDir)
+	}
+
+	for id, want := range trees {
+		if got := restoreTree(t, dstDir, id); !reflect.DeepEqual(got, want) {
+			t.Errorf("backup_id=%d: restored %v, want %v", id, got, want)
+		}
+	}
+}
+
+// A path is restored as it was at the given time
+func TestRestorePathAt(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"d/a.txt": "first", "d/b.txt": "b", "other.txt": "other"})
+	first, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, srcDir, map[string]string{"d/a.txt": "second", "d/c.txt": "added"})
+	if err := os.Remove(filepath.Join(srcDir, "d", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	second, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The backups ran within a second; a day apart they can be told by time
+	day := func(d, h int) time.Time {
+		return time.Date(2026, 9, d, h, 0, 0, 0, time.Local)
+	}
+	setDate(t, dstDir, first.ID, day(1, 0))
+	setDate(t, dstDir, second.ID, day(2, 0))
+
+	tests := []struct {
+		at   time.Time
+		want map[string]string
+	}{
+		{day(1, 12), map[string]string{"d/a.txt": "first", "d/b.txt": "b"}},
+		{day(2, 0), map[string]string{"d/a.txt": "second", "d/c.txt": "added"}},
+		{day(3, 0), map[string]string{"d/a.txt": "second", "d/c.txt": "added"}},
+	}
+	for _, tt := range tests {
+		target := t.TempDir()
+		if err := restorePath(t, dstDir, filepath.Join(srcDir, "d"), tt.at, 0, target); err != nil {
+			t.Errorf("%s: %v", tt.at, err)
+			continue
+		}
+		if got := readTree(t, target); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: restored %v, want %v", tt.at, got, tt.want)
+		}
+	}
+
+	// A single file, bounded by a backup ID
+	target := t.TempDir()
+	if err := restorePath(t, dstDir, filepath.Join(srcDir, "d", "a.txt"), day(3, 0), first.ID, target); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, target); !reflect.DeepEqual(got, map[string]string{"a.txt": "first"}) {
+		t.Errorf("restored %v", got)
+	}
+
+	if err := restorePath(t, dstDir, filepath.Join(srcDir, "d"), day(1, 0).Add(-time.Second), 0, t.TempDir()); err == nil {
+		t.Error("path restored from before the first backup")
+	}
+}
+
+// A file stored by a backup which was pruned later is restored from the kept
+// backups; the pruned backup itself cannot be restored
+func TestRestorePruned(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "unchanged", "b.txt": "first"})
+	first, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, srcDir, map[string]string{"b.txt": "second"})
+	last, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPrune(dstDir, RetentionPolicy{Last: 1}, false)
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	err = p.Prune()
+	p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a.txt": "unchanged", "b.txt": "second"}
+	if got := restoreTree(t, dstDir, last.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	target := t.TempDir()
+	if err := restorePath(t, dstDir, filepath.Join(srcDir, "a.txt"), time.Now(), 0, target); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, target); got["a.txt"] != "unchanged" {
+		t.Errorf("restored %v", got)
+	}
+
+	r := NewRestore(dstDir, false)
+	if err := r.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.Restore(first.ID, t.TempDir()); err == nil {
+		t.Error("pruned backup restored")
+	}
+	if err := r.RestorePath(filepath.Join(srcDir, "a.txt"), time.Now(), first.ID, t.TempDir()); err == nil {
+		t.Error("path restored from a pruned backup")
+	}
+}
+
+// A file whose copy failed in the last backup is restored from an older copy;
+// one without an older copy is missing
+func TestRestoreLastCopyFailed(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "first", "b.txt": "b"})
+	if _, err := runBackup(t, srcDir, dstDir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, srcDir, map[string]string{"a.txt": "second", "c.txt": "new"})
+	b := newTestBackup(t, srcDir, dstDir, nil)
+	// Directories in the way of the copies
+	for _, name := range []string{"a.txt", "c.txt"} {
+		if err := os.MkdirAll(filepath.Join(b.tempDir, name, "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := finishBackup(b)
+	if !IsPartial(err) || s.BackupFailure != 2 {
+		t.Fatalf("backup not partial with 2 files failed: %v", err)
+	}
+
+	target := t.TempDir()
+	r := restoreInto(t, dstDir, s.ID, target)
+	if r.Missing != 1 || r.Failed > 0 {
+		t.Errorf("%d files missing, %d failed, want 1 missing", r.Missing, r.Failed)
+	}
+	if got, want := readTree(t, target), map[string]string{"a.txt": "first", "b.txt": "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+
+	target = t.TempDir()
+	if err := restorePath(t, dstDir, filepath.Join(srcDir, "a.txt"), time.Now(), 0, target); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTree(t, target); got["a.txt"] != "first" {
+		t.Errorf("restored %v", got)
+	}
+
+	// The next backup stores them
+	next, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := restoreTree(t, dstDir, next.ID), readTree(t, srcDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+}
+
+// restorePath restores a path as it was at the given time into targetDir
+func restorePath(t *testing.T, dstDir, path string, at time.Time, backupID int64, targetDir string) error {
+	t.Helper()
+	r := NewRestore(dstDir, false)
+	if err := r.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	return r.RestorePath(path, at, backupID, targetDir)
+}
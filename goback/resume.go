@@ -0,0 +1,162 @@
+package goback
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Resume finishes or rolls back backups interrupted by a crash
+type Resume struct {
+	dstDir string
+	debug  bool
+
+	Jobs       []string // Resume only backups of these jobs; all if empty
+	Rollback   bool     // Delete interrupted backups instead of finishing them
+	Workers    int
+	WaitLock   bool
+	Passphrase string
+
+	Resumed    uint32
+	RolledBack uint32
+	Failed     uint32
+}
+
+func NewResume(dstDir string, debug bool) *Resume {
+	r := Resume{
+		dstDir:  dstDir,
+		debug:   debug,
+		Workers: defaultOptions().Workers,
+	}
+	return &r
+}
+
+// Run resumes or rolls back every interrupted backup in the destination directory
+func (r *Resume) Run() error {
+	if r.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	runs, err := r.interrupted()
+	if err != nil {
+		return err
+	}
+	if len(runs) < 1 {
+		log.Info("no interrupted backup")
+		return nil
+	}
+
+	for _, run := range runs {
+		if err := r.resume(run); err != nil {
+			log.Errorf("%s: %s", run, err.Error())
+			r.Failed++
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"resumed":     r.Resumed,
+		"rolled_back": r.RolledBack,
+		"failed":      r.Failed,
+	}).Info("resume result")
+	if r.Failed > 0 {
+		return fmt.Errorf("%d of %d interrupted backups failed", r.Failed, len(runs))
+	}
+	return nil
+}
+
+// interrupted returns the selected interrupted backups.
+// The lock is held only while looking; every backup resumed takes it again.
+func (r *Resume) interrupted() ([]*interruptedRun, error) {
+	lock, err := acquireLock(r.dstDir, r.WaitLock)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+
+	runs, err := findInterrupted(r.dstDir)
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]*interruptedRun, 0, len(runs))
+	for _, run := range runs {
+		if run.Header != nil && !r.selected(run.Header.Job) {
+			continue
+		}
+		selected = append(selected, run)
+	}
+	return selected, nil
+}
+
+func (r *Resume) selected(job string) bool {
+	if len(r.Jobs) < 1 {
+		return true
+	}
+	for _, j := range r.Jobs {
+		if j == job {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Resume) resume(run *interruptedRun) error {
+	if r.Rollback {
+		log.Infof("rolling back: %s", run)
+		if err := rollback(r.dstDir, run, r.WaitLock); err != nil {
+			return err
+		}
+		r.RolledBack++
+		return nil
+	}
+
+	if run.Header == nil {
+		return errors.New("cannot be resumed with an unreadable journal; roll it back")
+	}
+	log.Infof("resuming: %s", run)
+	b := NewBackup(run.Header.SrcDir, r.dstDir, r.debug)
+	b.resumeDir = run.Dir
+	b.Options.Job = run.Header.Job
+	b.Options.Dedup = run.Header.Dedup
+	b.Options.Checksum = run.Header.Checksum
+	b.Options.Excludes = run.Header.Excludes
+	b.Options.Compression = run.Header.Compression
+	b.Options.CompressionLevel = run.Header.CompressionLevel
+	b.Options.SkipCompress = run.Header.SkipCompress
+	b.Options.Archive = run.Header.Archive
+	b.Options.Snapshot = run.Header.Snapshot
+	b.Options.Workers = r.Workers
+	b.Options.WaitLock = r.WaitLock
+	b.Options.Passphrase = r.Passphrase
+
+	if err := b.Initialize(); err != nil {
+		return err
+	}
+	err := b.Start()
+	if cerr := b.Close(); cerr != nil && (err == nil || IsPartial(err)) {
+		err = cerr
+	}
+	if err != nil && !IsPartial(err) {
+		return err
+	}
+	if err != nil {
+		log.Warnf("%s: %s", run, err.Error())
+	}
+	r.Resumed++
+	return nil
+}
+
+func rollback(dstDir string, run *interruptedRun, wait bool) error {
+	lock, err := acquireLock(dstDir, wait)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	storage, err := openDstStorage(dstDir)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	return run.rollback(storage)
+}
@@ -0,0 +1,247 @@
+package goback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// interruptBackup starts a backup of srcDir which stores the given files and then
+// stops as a crash would. It returns the temporary directory of the backup.
+func interruptBackup(t *testing.T, srcDir, dstDir string, files ...string) string {
+	t.Helper()
+	b := NewBackup(srcDir, dstDir, false)
+	if err := b.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		path := filepath.Join(srcDir, filepath.FromSlash(name))
+		f, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.store(newFileInfo(path, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.journal.close()
+	b.dbLogTx.Rollback()
+	b.dbOriginTx.Rollback()
+	b.dbLog.Close()
+	b.dbOrigin.Close()
+	b.storage.Close()
+	b.lock.release()
+	return b.tempDir
+}
+
+// Copies of source files named like temporary files are kept when a backup is resumed
+func TestResumeTempNames(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	files := map[string]string{
+		".tmprc":          "rc",
+		".tmp_cache/data": "cache",
+		"a.txt":           "a",
+	}
+	writeFiles(t, srcDir, files)
+	interruptBackup(t, srcDir, dstDir, ".tmprc", ".tmp_cache/data")
+
+	// A put cut short by the crash
+	writeFiles(t, filepath.Join(dstDir, putTempDir), map[string]string{putTempPrefix + "123": "partial"})
+
+	r := NewResume(dstDir, false)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Resumed != 1 {
+		t.Fatalf("%d backups resumed", r.Resumed)
+	}
+	if got := restoreTree(t, dstDir, 1); !reflect.DeepEqual(got, files) {
+		t.Errorf("restored %v, want %v", got, files)
+	}
+
+	objects, err := newLocalStorage(dstDir).List(putTempDir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) > 0 {
+		t.Errorf("temporary file left: %s", objects[0].Name)
+	}
+}
+
+// checkNoInterrupted checks that an interrupted backup left nothing behind
+func checkNoInterrupted(t *testing.T, dstDir, tempDir string) {
+	t.Helper()
+	runs, err := findInterrupted(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) > 0 {
+		t.Errorf("interrupted backup left: %s", runs[0])
+	}
+	if _, err := os.Stat(journalPath(tempDir)); !os.IsNotExist(err) {
+		t.Errorf("journal left: %v", err)
+	}
+}
+
+// A resumed backup reuses the copies of unchanged files in its journal, ignoring
+// a line cut short by the crash, and copies files changed since again
+func TestResume(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"a.txt":       "copied",
+		"b.txt":       "copied, then changed",
+		"c.txt":       "copied, then deleted",
+		"dir/d.txt":   "not copied",
+		"dir/e/f.txt": "not copied",
+	})
+	tempDir := interruptBackup(t, srcDir, dstDir, "a.txt", "b.txt", "c.txt")
+	appendJournal(t, tempDir, `{"path":"`+filepath.Join(srcDir, "dir", "d.txt")+`","size":`)
+	copied, err := os.Stat(filepath.Join(tempDir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFiles(t, srcDir, map[string]string{"b.txt": "changed"})
+	if err := os.Remove(filepath.Join(srcDir, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewResume(dstDir, false)
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if r.Resumed != 1 || r.Failed != 0 {
+		t.Fatalf("%d resumed, %d failed", r.Resumed, r.Failed)
+	}
+	checkNoInterrupted(t, dstDir, tempDir)
+	if n := countSummaries(t, dstDir); n != 1 {
+		t.Fatalf("%d backups in the catalog", n)
+	}
+
+	want := readTree(t, srcDir)
+	if got := restoreTree(t, dstDir, 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored %v, want %v", got, want)
+	}
+	c := newCatalog(dstDir)
+	if err := c.open(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := c.getSummary(1)
+	c.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, err := os.Stat(filepath.Join(s.DstDir, "a.txt")); err != nil || !os.SameFile(copied, reused) {
+		t.Errorf("copy of a.txt not reused: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.DstDir, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("copy of a deleted file kept: %v", err)
+	}
+}
+
+// A rolled back backup leaves nothing, so the next backup stores every file
+func TestRollback(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	files := map[string]string{"a.txt": "a", "b.txt": "b"}
+	writeFiles(t, srcDir, files)
+	tempDir := interruptBackup(t, srcDir, dstDir, "a.txt")
+	appendJournal(t, tempDir, `{"path":`)
+
+	r := NewResume(dstDir, false)
+	r.Rollback = true
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if r.RolledBack != 1 {
+		t.Fatalf("%d rolled back", r.RolledBack)
+	}
+	checkNoInterrupted(t, dstDir, tempDir)
+	if _, err := os.Stat(tempDir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory left: %v", err)
+	}
+	if n := countSummaries(t, dstDir); n != 0 {
+		t.Fatalf("%d backups in the catalog", n)
+	}
+
+	s, err := runBackup(t, srcDir, dstDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.BackupAdded != 2 {
+		t.Errorf("%d files added", s.BackupAdded)
+	}
+	if got := restoreTree(t, dstDir, s.ID); !reflect.DeepEqual(got, files) {
+		t.Errorf("restored %v, want %v", got, files)
+	}
+}
+
+// A backup whose journal cannot be read cannot be resumed, only rolled back
+func TestResumeUnreadableJournal(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a"})
+	tempDir := interruptBackup(t, srcDir, dstDir, "a.txt")
+	if err := ioutil.WriteFile(journalPath(tempDir), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewResume(dstDir, false)
+	if err := r.Run(); err == nil || r.Failed != 1 {
+		t.Fatalf("resumed with an unreadable journal: %v", err)
+	}
+	r = NewResume(dstDir, false)
+	r.Rollback = true
+	if err := r.Run(); err != nil || r.RolledBack != 1 {
+		t.Fatalf("rollback: %v", err)
+	}
+	checkNoInterrupted(t, dstDir, tempDir)
+}
+
+// Only directories with a journal are interrupted backups; a rollback leaves others alone
+func TestRollbackOnlyJournaled(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a"})
+	tempDir := interruptBackup(t, srcDir, dstDir, "a.txt")
+	others := map[string]string{
+		"bakery/bread.txt": "bread",
+		"bak123/data.txt":  "data",
+	}
+	writeFiles(t, dstDir, others)
+
+	r := NewResume(dstDir, false)
+	r.Rollback = true
+	if err := r.Run(); err != nil || r.RolledBack != 1 {
+		t.Fatalf("rollback: %d rolled back: %v", r.RolledBack, err)
+	}
+	checkNoInterrupted(t, dstDir, tempDir)
+	got := readTree(t, dstDir)
+	for name, data := range others {
+		if got[name] != data {
+			t.Errorf("%s deleted", name)
+		}
+	}
+}
+
+// A backup resumes when every file it copied before the crash is gone from the source,
+// which leaves its directory empty
+func TestResumeAllCopiesDeleted(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{"a.txt": "a", "dir/b.txt": "b"})
+	tempDir := interruptBackup(t, srcDir, dstDir, "a.txt", "dir/b.txt")
+	for _, name := range []string{"a.txt", "dir"} {
+		if err := os.RemoveAll(filepath.Join(srcDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := NewResume(dstDir, false)
+	if err := r.Run(); err != nil || r.Resumed != 1 {
+		t.Fatalf("%d resumed: %v", r.Resumed, err)
+	}
+	checkNoInterrupted(t, dstDir, tempDir)
+	if got := restoreTree(t, dstDir, 1); len(got) > 0 {
+		t.Errorf("restored %v", got)
+	}
+}
@@ -0,0 +1,108 @@
+package goback
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StorageSnapshot makes every dated directory a complete tree of the source.
+// Unchanged files are hard links into the previous snapshot.
+const StorageSnapshot = "snapshot"
+
+// initSnapshot checks that the storage can hold snapshots. Snapshots are plain
+// files in a local backup directory, so that they can be browsed.
+func (b *Backup) initSnapshot() error {
+	local, ok := b.storage.(*localStorage)
+	if !ok {
+		return errors.New("snapshots need a local backup directory")
+	}
+	b.snapshot = local
+	return nil
+}
+
+// findPrevSnapshot finds the snapshot taken by the last backup of the source, if it was one
+func (b *Backup) findPrevSnapshot(last *Summary) error {
+	if last.ID < 1 {
+		return nil
+	}
+	var dstDir, storage string
+	err := b.dbLog.QueryRow("select dst_dir, storage from bak_summary where id = ?", last.ID).Scan(&dstDir, &storage)
+	if err != nil {
+		return err
+	}
+	if storage == StorageSnapshot && dstDir != "" {
+		b.prevSnapshot = filepath.Base(dstDir)
+		log.Infof("previous snapshot: %s", dstDir)
+	}
+	return nil
+}
+
+// linkUnchanged links an unchanged file into the snapshot. A file missing
+// from the previous snapshot, or with no previous snapshot, is copied.
+func (b *Backup) linkUnchanged(fi *File) error {
+	name := b.copyName(fi.Path)
+	if fi.Mode&os.ModeSymlink != 0 {
+		if err := b.snapshot.symlink(fi.Link, name); err != nil {
+			return &FileError{Path: fi.Path, Err: err}
+		}
+		return nil
+	}
+
+	if b.prevSnapshot != "" {
+		err := b.snapshot.link(copyName(b.prevSnapshot, b.srcDir, fi.Path), name)
+		if err == nil || os.IsExist(err) {
+			return nil
+		}
+		log.Debugf("not in the previous snapshot: %s", fi.Path)
+	}
+	if _, _, err := b.BackupFile(fi.Path, CodecNone, fi.ModTime); err != nil {
+		return &FileError{Path: fi.Path, Err: err}
+	}
+	atomic.AddUint32(&b.unchangedCopied, 1)
+	return nil
+}
+
+// linkMoved links a moved file into the snapshot from its old path in the previous snapshot
+func (b *Backup) linkMoved(fi *File) error {
+	if fi.Mode&os.ModeSymlink == 0 && b.prevSnapshot != "" {
+		err := b.snapshot.link(copyName(b.prevSnapshot, b.srcDir, fi.OldPath), b.copyName(fi.Path))
+		if err == nil || os.IsExist(err) {
+			return nil
+		}
+	}
+	return b.linkUnchanged(fi)
+}
+
+// pruneSnapshot deletes the files of a pruned snapshot which no kept backup needs.
+// Unchanged files are links into other snapshots, so their data stays there.
+func (p *Prune) pruneSnapshot(s *Summary, needed map[string]bool) error {
+	dir := filepath.Base(s.DstDir)
+	objects, err := p.storage.List(dir + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		rel := strings.TrimPrefix(o.Name, dir+"/")
+		if needed[filepath.Join(s.SrcDir, filepath.FromSlash(rel))] {
+			continue
+		}
+		if err := p.storage.Delete(o.Name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotDirs creates the directories of the source in the snapshot, including empty ones
+func (b *Backup) snapshotDirs() {
+	for _, d := range b.dirs {
+		if err := os.MkdirAll(b.snapshot.path(b.copyName(d.Path)), 0755); err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package goback
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Every snapshot is a complete tree of the source whose unchanged and moved files
+// are links into the previous one
+func TestSnapshot(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"a.txt":     "a",
+		"dir/b.txt": "b",
+		"moved.txt": "moved",
+	})
+	if err := os.Mkdir(filepath.Join(srcDir, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func(o *Options) { o.Snapshot = true }
+	checkTree := func(s *Summary) {
+		t.Helper()
+		if got, want := readTree(t, s.DstDir), readTree(t, srcDir); !reflect.DeepEqual(got, want) {
+			t.Errorf("backup_id=%d: snapshot %v, want %v", s.ID, got, want)
+		}
+		if f, err := os.Stat(filepath.Join(s.DstDir, "empty")); err != nil || !f.IsDir() {
+			t.Errorf("backup_id=%d: empty directory not in the snapshot: %v", s.ID, err)
+		}
+		if link, err := os.Readlink(filepath.Join(s.DstDir, "link")); err != nil || link != "a.txt" {
+			t.Errorf("backup_id=%d: symlink %q: %v", s.ID, link, err)
+		}
+	}
+
+	first, err := runBackup(t, srcDir, dstDir, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Storage != StorageSnapshot {
+		t.Fatalf("storage: %s", first.Storage)
+	}
+	checkTree(first)
+
+	writeFiles(t, srcDir, map[string]string{"a.txt": "changed", "c.txt": "added file"})
+	moveFile(t, srcDir, "moved.txt", "dir/moved.txt")
+	second, err := runBackup(t, srcDir, dstDir, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(second)
+	if !sameFile(t, filepath.Join(first.DstDir, "dir", "b.txt"), filepath.Join(second.DstDir, "dir", "b.txt")) {
+		t.Error("unchanged file not linked")
+	}
+	if !sameFile(t, filepath.Join(first.DstDir, "moved.txt"), filepath.Join(second.DstDir, "dir", "moved.txt")) {
+		t.Error("moved file not linked")
+	}
+	if sameFile(t, filepath.Join(first.DstDir, "a.txt"), filepath.Join(second.DstDir, "a.txt")) {
+		t.Error("modified file linked")
+	}
+
+	// A file missing from the previous snapshot is copied
+	if err := os.Remove(filepath.Join(second.DstDir, "dir", "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	third, err := runBackup(t, srcDir, dstDir, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(third)
+	if sameFile(t, filepath.Join(first.DstDir, "dir", "b.txt"), filepath.Join(third.DstDir, "dir", "b.txt")) {
+		t.Error("file missing from the previous snapshot linked to an older one")
+	}
+	if !sameFile(t, filepath.Join(second.DstDir, "c.txt"), filepath.Join(third.DstDir, "c.txt")) {
+		t.Error("unchanged file not linked")
+	}
+}
@@ -0,0 +1,336 @@
+package goback
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage keeps the stored copies of a backup directory. Names are slash-separated
+// and relative to the root of the storage. The catalogs, the lock and the journals
+// always stay in the local backup directory.
+type Storage interface {
+	// Put stores the content of r under name. The object appears only when complete.
+	Put(name string, r io.Reader, modTime time.Time) error
+	// Get returns a reader of an object starting at offset
+	Get(name string, offset int64) (io.ReadCloser, error)
+	Stat(name string) (*ObjectInfo, error)
+	// List returns the objects whose names start with prefix. Temporary files
+	// of puts that were interrupted are listed under putTempDir.
+	List(prefix string) ([]*ObjectInfo, error)
+	Delete(name string) error
+	// Rename renames an object or every object under a directory name. It fails if to exists.
+	Rename(from, to string) error
+	Close() error
+}
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// OpenStorage opens the storage of a backup directory. An empty location is the backup directory itself.
+func OpenStorage(location, dstDir string) (Storage, error) {
+	if location == "" {
+		return newLocalStorage(dstDir), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Storage(u)
+	case "sftp":
+		return newSFTPStorage(u)
+	}
+	return nil, fmt.Errorf("unknown storage: %s", location)
+}
+
+// checkStorageURL checks the form of a storage location without connecting to it
+func checkStorageURL(location string) error {
+	if location == "" {
+		return nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return fmt.Errorf("no bucket: %s", location)
+		}
+		return nil
+	case "sftp":
+		if u.Hostname() == "" {
+			return fmt.Errorf("no host: %s", location)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown storage: %s", location)
+}
+
+// Puts write to temporary files in a directory of their own. Any name in the
+// directory of a run can be the copy of a source file, so none is used for them.
+// The directory is deleted when a backup closes; the files of interrupted puts are
+// deleted when the backup is resumed or rolled back.
+const (
+	putTempDir    = ".goback-tmp"
+	putTempPrefix = "put"
+)
+
+// copyName returns the storage name of the copy of a file in a backup directory
+func copyName(dir, srcDir, file string) string {
+	return path.Join(dir, filepath.ToSlash(relPath(srcDir, file)))
+}
+
+// Name of the storage location in bak_meta
+const metaStorageURL = "storage_url"
+
+func getMeta(db *sql.DB, name string) (string, error) {
+	var value string
+	err := db.QueryRow("select value from bak_meta where name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+func setMeta(db *sql.DB, name, value string) error {
+	_, err := db.Exec("insert or replace into bak_meta(name, value) values(?, ?)", name, value)
+	return err
+}
+
+// openDstStorage opens the storage recorded in the log database of a backup directory
+func openDstStorage(dstDir string) (Storage, error) {
+	db, err := openLogDB(dstDir)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return OpenStorage("", dstDir)
+	}
+	defer db.Close()
+
+	location, err := getMeta(db, metaStorageURL)
+	if err != nil {
+		return nil, err
+	}
+	return OpenStorage(location, dstDir)
+}
+
+// putWriter returns a writer whose data is stored under name when it is closed
+func putWriter(s Storage, name string, modTime time.Time) *storageWriter {
+	pr, pw := io.Pipe()
+	w := &storageWriter{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := s.Put(name, pr, modTime)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+type storageWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *storageWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *storageWriter) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// abort discards the data written so far
+func (w *storageWriter) abort(err error) {
+	w.pw.CloseWithError(err)
+	<-w.done
+}
+
+// deletePrefix deletes every object under a directory name
+func deletePrefix(s Storage, dir string) error {
+	objects, err := s.List(dir + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.Delete(o.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localStorage keeps copies in a local directory
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) *localStorage {
+	return &localStorage{
+		dir: filepath.Clean(dir),
+	}
+}
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *localStorage) Put(name string, r io.Reader, modTime time.Time) error {
+	dst := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.path(putTempDir), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.path(putTempDir), putTempPrefix)
+	if err != nil {
+		return err
+	}
+	// The copy is on disk before a journal can record it
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil && !modTime.IsZero() {
+		err = os.Chtimes(tmp.Name(), modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (s *localStorage) Get(name string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *localStorage) Stat(name string) (*ObjectInfo, error) {
+	fi, err := os.Stat(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:    name,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (s *localStorage) List(prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+
+	// Walk the deepest directory covering the prefix
+	dir := s.path(path.Dir(prefix + "x"))
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == dir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, &ObjectInfo{
+				Name:    name,
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// Delete deletes an object and the directories left empty by it
+func (s *localStorage) Delete(name string) error {
+	p := s.path(name)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(p); dir != s.dir && strings.HasPrefix(dir, s.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *localStorage) Rename(from, to string) error {
+	if _, err := os.Lstat(s.path(to)); err == nil {
+		return os.ErrExist
+	}
+	err := os.Rename(s.path(from), s.path(to))
+	if os.IsNotExist(err) {
+		// A run which kept no copy has no directory; Delete removes empty ones
+		if _, serr := os.Lstat(s.path(from)); os.IsNotExist(serr) {
+			return nil
+		}
+	}
+	return err
+}
+
+// link creates a hard link to an object
+func (s *localStorage) link(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(to)), 0755); err != nil {
+		return err
+	}
+	return os.Link(s.path(from), s.path(to))
+}
+
+// symlink creates a symlink, replacing an existing one
+func (s *localStorage) symlink(target, name string) error {
+	if err := os.MkdirAll(filepath.Dir(s.path(name)), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, s.path(name))
+}
+
+func (s *localStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,201 @@
+package goback
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage keeps copies in an S3-compatible bucket.
+//
+//	s3://bucket/prefix?endpoint=minio.local:9000&region=us-east-1&insecure=true
+//
+// Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+// S3 has no rename, so renaming a directory copies and deletes every object under it.
+type s3Storage struct {
+	client   *minio.Client
+	bucket   string
+	prefix   string
+	partSize uint64 // Part size of copies; 0 means the largest part, 5 GiB
+}
+
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	q := u.Query()
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "s3.amazonaws.com"
+	}
+	insecure, _ := strconv.ParseBool(q.Get("insecure"))
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewEnvAWS(),
+		Secure: !insecure,
+		Region: q.Get("region"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("no bucket: " + u.String())
+	}
+
+	s := &s3Storage{
+		client: client,
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}
+	ok, err := client.BucketExists(context.Background(), s.bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("bucket not found: " + s.bucket)
+	}
+	return s, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3Storage) name(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return strings.TrimPrefix(key, s.prefix+"/")
+}
+
+func (s *s3Storage) Put(name string, r io.Reader, modTime time.Time) error {
+	// The size is unknown; parts are buffered in memory
+	opts := minio.PutObjectOptions{PartSize: 16 << 20}
+	if !modTime.IsZero() {
+		opts.UserMetadata = map[string]string{"mtime": modTime.Format(time.RFC3339Nano)}
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.key(name), r, -1, opts)
+	return err
+}
+
+func (s *s3Storage) Get(name string, offset int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return nil, err
+		}
+	}
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.key(name), opts)
+	if err != nil {
+		return nil, s.convertErr(name, err)
+	}
+	// GetObject does not fail on missing objects until the first read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, s.convertErr(name, err)
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Stat(name string) (*ObjectInfo, error) {
+	info, err := s.client.StatObject(context.Background(), s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		return nil, s.convertErr(name, err)
+	}
+	return s.objectInfo(info), nil
+}
+
+func (s *s3Storage) List(prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+	for info := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{
+		Prefix:    s.key(prefix),
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects = append(objects, s.objectInfo(info))
+	}
+	return objects, nil
+}
+
+func (s *s3Storage) Delete(name string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) Rename(from, to string) error {
+	if _, err := s.Stat(to); err == nil {
+		return os.ErrExist
+	}
+	existing, err := s.List(to + "/")
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return os.ErrExist
+	}
+
+	// A single object
+	if _, err := s.Stat(from); err == nil {
+		return s.move(from, to)
+	}
+
+	// A run which copied nothing has no objects
+	objects, err := s.List(from + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := s.move(o.Name, path.Join(to, strings.TrimPrefix(o.Name, from+"/"))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move copies an object and deletes it. A single copy is limited to 5 GiB;
+// ComposeObject copies larger objects in parts.
+func (s *s3Storage) move(from, to string) error {
+	_, err := s.client.ComposeObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.key(to), PartSize: s.partSize},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.key(from)},
+	)
+	if err != nil {
+		return err
+	}
+	return s.Delete(from)
+}
+
+func (s *s3Storage) Close() error {
+	return nil
+}
+
+func (s *s3Storage) objectInfo(info minio.ObjectInfo) *ObjectInfo {
+	o := &ObjectInfo{
+		Name:    s.name(info.Key),
+		Size:    info.Size,
+		ModTime: info.LastModified,
+	}
+	if mtime, ok := info.UserMetadata["Mtime"]; ok {
+		if t, err := time.Parse(time.RFC3339Nano, mtime); err == nil {
+			o.ModTime = t
+		}
+	}
+	return o
+}
+
+// convertErr returns os.ErrNotExist for missing objects, so that callers can use os.IsNotExist
+func (s *s3Storage) convertErr(name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return &os.PathError{Op: "get", Path: s.key(name), Err: os.ErrNotExist}
+	}
+	return err
+}
@@ -0,0 +1,227 @@
+package goback
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// fakeS3 is an in-process S3 server. It adds what gofakes3 lacks and minio-go uses:
+// aws-chunked bodies and copies of parts.
+type fakeS3 struct {
+	server     http.Handler
+	partCopies int32
+}
+
+func newTestS3Storage(t *testing.T) (*s3Storage, *fakeS3) {
+	backend := s3mem.New()
+	if err := backend.CreateBucket("bkt"); err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeS3{server: gofakes3.New(backend).Server()}
+	ts := httptest.NewServer(f)
+	t.Cleanup(ts.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	u, err := url.Parse("s3://bkt/backup?insecure=true&endpoint=" + strings.TrimPrefix(ts.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newS3Storage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, f
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING") {
+		data := decodeChunked(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(data))
+		r.ContentLength = int64(len(data))
+		r.Header.Set("Content-Length", strconv.Itoa(len(data)))
+		r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+		r.Header.Del("Content-Encoding")
+	}
+	if r.Method == http.MethodPut && r.URL.Query().Get("uploadId") != "" && r.Header.Get("X-Amz-Copy-Source") != "" {
+		f.copyPart(w, r)
+		return
+	}
+	f.server.ServeHTTP(w, r)
+}
+
+// copyPart reads the range of the source and uploads it as a part
+func (f *fakeS3) copyPart(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&f.partCopies, 1)
+	src, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	get := httptest.NewRequest(http.MethodGet, "/"+strings.TrimPrefix(src, "/"), nil)
+	get.Header.Set("Range", r.Header.Get("X-Amz-Copy-Source-Range"))
+	got := httptest.NewRecorder()
+	f.server.ServeHTTP(got, get)
+	if got.Code != http.StatusOK && got.Code != http.StatusPartialContent {
+		http.Error(w, got.Body.String(), got.Code)
+		return
+	}
+
+	data := got.Body.Bytes()
+	put := httptest.NewRequest(http.MethodPut, r.URL.String(), bytes.NewReader(data))
+	put.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	put.ContentLength = int64(len(data))
+	put.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	done := httptest.NewRecorder()
+	f.server.ServeHTTP(done, put)
+	if done.Code != http.StatusOK {
+		http.Error(w, done.Body.String(), done.Code)
+		return
+	}
+	xml.NewEncoder(w).Encode(struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified string
+	}{ETag: done.Header().Get("ETag"), LastModified: time.Now().UTC().Format(time.RFC3339)})
+}
+
+func decodeChunked(r io.Reader) []byte {
+	br := bufio.NewReader(r)
+	var out bytes.Buffer
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return out.Bytes()
+		}
+		n, _ := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if n == 0 {
+			return out.Bytes()
+		}
+		io.CopyN(&out, br, n)
+		br.ReadString('\n')
+	}
+}
+
+func TestS3Storage(t *testing.T) {
+	s, _ := newTestS3Storage(t)
+	modTime := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.Put("20260901/a/b.txt", strings.NewReader("hello world"), modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readObject(t, s, "20260901/a/b.txt", 0); got != "hello world" {
+		t.Errorf("get: %q", got)
+	}
+	if got := readObject(t, s, "20260901/a/b.txt", 6); got != "world" {
+		t.Errorf("get at 6: %q", got)
+	}
+
+	info, err := s.Stat("20260901/a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "20260901/a/b.txt" || info.Size != 11 || !info.ModTime.Equal(modTime) {
+		t.Errorf("stat: %+v", info)
+	}
+
+	objects, err := s.List("20260901/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Name != "20260901/a/b.txt" {
+		t.Errorf("list: %+v", objects)
+	}
+
+	if err := s.Delete("20260901/a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("20260901/a/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat of a deleted object: %v", err)
+	}
+	if _, err := s.Get("20260901/a/b.txt", 0); !os.IsNotExist(err) {
+		t.Errorf("get of a deleted object: %v", err)
+	}
+}
+
+func TestS3StorageRename(t *testing.T) {
+	s, _ := newTestS3Storage(t)
+	for _, name := range []string{".tmp1/a.txt", ".tmp1/dir/b.txt"} {
+		if err := s.Put(name, strings.NewReader(name), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Rename(".tmp1", "20260901"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, "20260901/dir/b.txt", 0); got != ".tmp1/dir/b.txt" {
+		t.Errorf("renamed object: %q", got)
+	}
+	objects, err := s.List(".tmp1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("objects left: %+v", objects)
+	}
+
+	// A single object
+	if err := s.Put(".tmp2", strings.NewReader("archive"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(".tmp2", "20260901_1.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, "20260901_1.tar", 0); got != "archive" {
+		t.Errorf("renamed archive: %q", got)
+	}
+
+	// The destination exists
+	if err := s.Put(".tmp3/a.txt", strings.NewReader("a"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(".tmp3", "20260901"); err != os.ErrExist {
+		t.Errorf("rename onto a directory: %v", err)
+	}
+	if err := s.Rename(".tmp3", "20260901_1.tar"); err != os.ErrExist {
+		t.Errorf("rename onto an object: %v", err)
+	}
+}
+
+// Objects larger than a part are copied in parts, as a single copy is limited to 5 GiB
+func TestS3StorageRenameParts(t *testing.T) {
+	s, f := newTestS3Storage(t)
+	s.partSize = 5 << 20
+	data := bytes.Repeat([]byte("0123456789abcdef"), (12<<20)/16)
+	if err := s.Put(".tmp1/large", bytes.NewReader(data), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Rename(".tmp1", "20260901"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&f.partCopies); n != 3 {
+		t.Errorf("%d parts copied, want 3", n)
+	}
+	if got := readObject(t, s, "20260901/large", 0); got != string(data) {
+		t.Errorf("renamed object: %d bytes, want %d", len(got), len(data))
+	}
+	if _, err := s.Stat(".tmp1/large"); !os.IsNotExist(err) {
+		t.Errorf("source left: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package goback
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpStorage keeps copies in a directory of an SSH server.
+//
+//	sftp://user@backup.local:22/backup?key=/etc/goback/id_ed25519&known_hosts=/etc/goback/known_hosts
+//
+// Only key authentication is supported. The key defaults to ~/.ssh/id_ed25519, id_ecdsa or id_rsa
+// and the host key is checked against ~/.ssh/known_hosts unless known_hosts is given.
+type sftpStorage struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	dir    string
+}
+
+func newSFTPStorage(u *url.URL) (*sftpStorage, error) {
+	if u.Hostname() == "" {
+		return nil, errors.New("no host: " + u.String())
+	}
+	config, err := sshConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(u.Hostname(), port), config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	s := &sftpStorage{
+		conn:   conn,
+		client: client,
+		dir:    path.Clean(dir),
+	}
+	fi, err := client.Stat(s.dir)
+	if err == nil && !fi.IsDir() {
+		err = errors.New("not a directory: " + s.dir)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func sshConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	q := u.Query()
+	home, _ := os.UserHomeDir()
+
+	name := u.User.Username()
+	if name == "" {
+		cur, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		name = cur.Username
+	}
+
+	keyFile := q.Get("key")
+	if keyFile == "" {
+		for _, f := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			p := filepath.Join(home, ".ssh", f)
+			if _, err := os.Stat(p); err == nil {
+				keyFile = p
+				break
+			}
+		}
+		if keyFile == "" {
+			return nil, errors.New("no private key; set key in the storage location")
+		}
+	}
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err.Error())
+	}
+
+	hostsFile := q.Get("known_hosts")
+	if hostsFile == "" {
+		hostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKey, err := knownhosts.New(hostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            name,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+func (s *sftpStorage) path(name string) string {
+	return path.Join(s.dir, name)
+}
+
+func (s *sftpStorage) Put(name string, r io.Reader, modTime time.Time) error {
+	dst := s.path(name)
+	if err := s.client.MkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+	if err := s.client.MkdirAll(s.path(putTempDir)); err != nil {
+		return err
+	}
+	f, tmp, err := s.createTemp(s.path(putTempDir))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = syncFile(f)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil && !modTime.IsZero() {
+		err = s.client.Chtimes(tmp, modTime, modTime)
+	}
+	if err == nil {
+		err = s.replace(tmp, dst)
+	}
+	if err != nil {
+		s.client.Remove(tmp)
+	}
+	return err
+}
+
+// syncFile flushes a file to stable storage, so that a journal never records a copy
+// which is not there after a crash. Servers without fsync cannot.
+func syncFile(f *sftp.File) error {
+	err := f.Sync()
+	if se, ok := err.(*sftp.StatusError); ok && se.FxCode() == sftp.ErrSSHFxOpUnsupported {
+		return nil
+	}
+	return err
+}
+
+// createTemp creates a temporary file of a random name in a directory. It never opens
+// an existing file, so that puts of concurrent runs cannot write to the same file.
+func (s *sftpStorage) createTemp(dir string) (*sftp.File, string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	name := path.Join(dir, putTempPrefix+hex.EncodeToString(b))
+	f, err := s.client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, name, nil
+}
+
+// replace renames a file over an existing one
+func (s *sftpStorage) replace(from, to string) error {
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.client.PosixRename(from, to)
+	}
+	if err := s.client.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.client.Rename(from, to)
+}
+
+func (s *sftpStorage) Get(name string, offset int64) (io.ReadCloser, error) {
+	f, err := s.client.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (s *sftpStorage) Stat(name string) (*ObjectInfo, error) {
+	fi, err := s.client.Stat(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Name:    name,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+func (s *sftpStorage) List(prefix string) ([]*ObjectInfo, error) {
+	objects := make([]*ObjectInfo, 0)
+
+	// Walk the deepest directory covering the prefix
+	root := s.path(path.Dir(prefix + "x"))
+	w := s.client.Walk(root)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			if os.IsNotExist(err) && w.Path() == root {
+				return objects, nil
+			}
+			return nil, err
+		}
+		fi := w.Stat()
+		if fi.IsDir() {
+			continue
+		}
+		name := strings.TrimPrefix(w.Path(), s.dir+"/")
+		if s.dir == "." {
+			name = w.Path()
+		}
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, &ObjectInfo{
+				Name:    name,
+				Size:    fi.Size(),
+				ModTime: fi.ModTime(),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// Delete deletes an object and the directories left empty by it
+func (s *sftpStorage) Delete(name string) error {
+	p := s.path(name)
+	if err := s.client.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := path.Dir(p); dir != s.dir && dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if s.client.RemoveDirectory(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *sftpStorage) Rename(from, to string) error {
+	if _, err := s.client.Lstat(s.path(to)); err == nil {
+		return os.ErrExist
+	}
+	err := s.client.Rename(s.path(from), s.path(to))
+	if os.IsNotExist(err) {
+		// A run which copied nothing has no directory
+		if _, serr := s.client.Lstat(s.path(from)); os.IsNotExist(serr) {
+			return nil
+		}
+	}
+	return err
+}
+
+func (s *sftpStorage) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,232 @@
+package goback
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// newTestSFTPStorage serves a temporary directory over SFTP by an in-process SSH server
+func newTestSFTPStorage(t *testing.T) (*sftpStorage, string) {
+	tmp := t.TempDir()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, userPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKey, err := ssh.NewSignerFromKey(userPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), userKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveSFTP(l, config)
+
+	// Client key and known hosts
+	block, err := ssh.MarshalPrivateKey(userPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(tmp, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	hostsFile := filepath.Join(tmp, "known_hosts")
+	line := knownhosts.Line([]string{l.Addr().String()}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(hostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(tmp, "backup")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse("sftp://goback@" + l.Addr().String() + dir + "?key=" + keyFile + "&known_hosts=" + hostsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSFTPStorage(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, dir
+}
+
+func serveSFTP(l net.Listener, config *ssh.ServerConfig) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(c, config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for nc := range chans {
+				ch, reqs, err := nc.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					for r := range reqs {
+						ok := r.Type == "subsystem" && string(r.Payload[4:]) == "sftp"
+						r.Reply(ok, nil)
+						if ok {
+							if server, err := sftp.NewServer(ch); err == nil {
+								server.Serve()
+							}
+							ch.Close()
+						}
+					}
+				}()
+			}
+		}()
+	}
+}
+
+func TestSFTPStorage(t *testing.T) {
+	s, dir := newTestSFTPStorage(t)
+	modTime := time.Date(2026, 9, 1, 12, 0, 0, 0, time.UTC)
+	if err := s.Put("20260901/a/b.txt", strings.NewReader("hello world"), modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readObject(t, s, "20260901/a/b.txt", 0); got != "hello world" {
+		t.Errorf("get: %q", got)
+	}
+	if got := readObject(t, s, "20260901/a/b.txt", 6); got != "world" {
+		t.Errorf("get at 6: %q", got)
+	}
+
+	info, err := s.Stat("20260901/a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 11 || !info.ModTime.Equal(modTime) {
+		t.Errorf("stat: %+v", info)
+	}
+
+	// Puts leave no temporary files
+	objects, err := s.List("20260901/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Name != "20260901/a/b.txt" {
+		t.Errorf("list: %+v", objects)
+	}
+	if objects, err := s.List("none/"); err != nil || len(objects) != 0 {
+		t.Errorf("list of a missing directory: %+v, %v", objects, err)
+	}
+
+	// Deleting the last object deletes its directories
+	if err := s.Delete("20260901/a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat("20260901/a/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat of a deleted object: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "20260901")); !os.IsNotExist(err) {
+		t.Errorf("directory left: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("storage directory deleted: %v", err)
+	}
+}
+
+// Concurrent puts write to temporary files of their own
+func TestSFTPStoragePutConcurrent(t *testing.T) {
+	s, _ := newTestSFTPStorage(t)
+	data := make([]string, 16)
+	for i := range data {
+		data[i] = strings.Repeat(string(rune('a'+i)), 64<<10)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(data))
+	for i := range data {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.Put("20260901/f"+string(rune('a'+i)), strings.NewReader(data[i]), time.Time{})
+		}(i)
+	}
+	wg.Wait()
+	for i := range data {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if got := readObject(t, s, "20260901/f"+string(rune('a'+i)), 0); got != data[i] {
+			t.Errorf("object %d: %d bytes of %q", i, len(got), got[:1])
+		}
+	}
+
+	f, name, err := s.createTemp(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := s.client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL); err == nil {
+		t.Errorf("%s opened again", name)
+	}
+}
+
+func TestSFTPStorageRename(t *testing.T) {
+	s, _ := newTestSFTPStorage(t)
+	for _, name := range []string{".tmp1/a.txt", ".tmp1/dir/b.txt", ".tmp2/c.txt"} {
+		if err := s.Put(name, strings.NewReader(name), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Rename(".tmp1", "20260901"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, s, "20260901/dir/b.txt", 0); got != ".tmp1/dir/b.txt" {
+		t.Errorf("renamed object: %q", got)
+	}
+	if err := s.Rename(".tmp2", "20260901"); err != os.ErrExist {
+		t.Errorf("rename onto a directory: %v", err)
+	}
+
+	// A run which copied nothing
+	if err := s.Rename(".tmp3", "20260902"); err != nil {
+		t.Errorf("rename of nothing: %v", err)
+	}
+}
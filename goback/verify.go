@@ -0,0 +1,210 @@
+package goback
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+type VerifyResult struct {
+	BackupID  int64
+	Date      time.Time
+	Checked   uint32
+	Missing   uint32
+	Corrupted uint32
+	State     int
+	Message   string
+}
+
+type Verify struct {
+	*catalog
+	debug bool
+
+	Passphrase string // Required if the backup directory is encrypted
+
+	Results []*VerifyResult
+}
+
+func NewVerify(dstDir string, debug bool) *Verify {
+	v := Verify{
+		catalog: newCatalog(dstDir),
+		debug:   debug,
+	}
+	return &v
+}
+
+// Initialize
+func (v *Verify) Initialize() error {
+	if err := v.open(); err != nil {
+		return err
+	}
+	if err := v.unlock(v.Passphrase); err != nil {
+		v.close()
+		return err
+	}
+
+	if v.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	return nil
+}
+
+// Verify checks the files that were successfully backed up by a backup,
+// or by every backup if backupID is 0, and records a result per backup
+func (v *Verify) Verify(backupID int64) error {
+	ids, err := v.getBackupIDs(backupID)
+	if err != nil {
+		return err
+	}
+	if backupID > 0 && len(ids) < 1 {
+		return fmt.Errorf("backup not found: %d", backupID)
+	}
+
+	for _, id := range ids {
+		result, err := v.verifyBackup(id)
+		if err != nil {
+			return err
+		}
+		if err := v.writeResult(result); err != nil {
+			return err
+		}
+		v.Results = append(v.Results, result)
+
+		entry := log.WithFields(log.Fields{
+			"checked":   result.Checked,
+			"missing":   result.Missing,
+			"corrupted": result.Corrupted,
+		})
+		if result.State < 0 {
+			entry.Errorf("backup_id=%d failed verification", id)
+		} else {
+			entry.Infof("backup_id=%d verified", id)
+		}
+	}
+	return nil
+}
+
+// Failed returns true if any verified backup has missing or corrupted files
+func (v *Verify) Failed() bool {
+	for _, r := range v.Results {
+		if r.State < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Verify) getBackupIDs(backupID int64) ([]int64, error) {
+	rows, err := v.db.Query("select id from bak_summary where state > 0 and pruned = 0 and (? = 0 or id = ?) order by id asc", backupID, backupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (v *Verify) verifyBackup(backupID int64) (*VerifyResult, error) {
+	result := &VerifyResult{
+		BackupID: backupID,
+		Date:     time.Now(),
+		State:    1,
+	}
+
+	versions, err := v.queryVersions("t1.id = ? and t1.state in (?, ?)", backupID, FileAdded, FileModified)
+	if err != nil {
+		return nil, err
+	}
+	for _, ver := range versions {
+		result.Checked++
+		err := v.verifyVersion(ver)
+		if err == nil {
+			continue
+		}
+
+		log.Errorf("%s: %s", ver.Path, err.Error())
+		if os.IsNotExist(err) {
+			result.Missing++
+		} else {
+			result.Corrupted++
+		}
+		if result.Message == "" {
+			result.Message = fmt.Sprintf("%s: %s", ver.Path, err.Error())
+		}
+	}
+	if result.Missing+result.Corrupted > 0 {
+		result.State = -1
+	}
+
+	return result, nil
+}
+
+// verifyVersion checks existence and size of the stored copy and,
+// when available, its checksum. Chunks are always checked against their hash
+// and compressed or encrypted copies are always read.
+func (v *Verify) verifyVersion(ver *Version) error {
+	if ver.Mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	if (ver.Storage == StorageFile || ver.Storage == StorageSnapshot) && ver.Codec == CodecNone && !ver.Encrypted {
+		fi, err := v.storage.Stat(ver.storageName())
+		if err != nil {
+			return err
+		}
+		if fi.Size != ver.Size {
+			return fmt.Errorf("size mismatch: %d, expected %d", fi.Size, ver.Size)
+		}
+		if ver.Hash == "" {
+			return nil
+		}
+	}
+
+	r, err := v.Open(ver)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return err
+	}
+	if size != ver.Size {
+		return fmt.Errorf("size mismatch: %d, expected %d", size, ver.Size)
+	}
+	if ver.Hash != "" && hex.EncodeToString(h.Sum(nil)) != ver.Hash {
+		return fmt.Errorf("checksum mismatch")
+	}
+	return nil
+}
+
+func (v *Verify) writeResult(r *VerifyResult) error {
+	_, err := v.db.Exec("insert into bak_verify(backup_id, date, checked, missing, corrupted, state, message) values(?, ?, ?, ?, ?, ?, ?)",
+		r.BackupID,
+		r.Date.Format(time.RFC3339),
+		r.Checked,
+		r.Missing,
+		r.Corrupted,
+		r.State,
+		r.Message,
+	)
+	return err
+}
+
+func (v *Verify) Close() error {
+	return v.close()
+}
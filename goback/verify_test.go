@@ -0,0 +1,75 @@
+package goback
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runVerify verifies a backup, or every backup if backupID is 0
+func runVerify(t *testing.T, dstDir string, backupID int64) *Verify {
+	t.Helper()
+	v := NewVerify(dstDir, false)
+	if err := v.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if err := v.Verify(backupID); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// Copies which are gone are missing, and those which differ from the logged size or checksum are corrupted
+func TestVerify(t *testing.T) {
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	writeFiles(t, srcDir, map[string]string{
+		"deleted.txt":   "deleted",
+		"rewritten.txt": "rewritten",
+		"truncated.txt": "truncated",
+		"kept.txt":      "kept",
+	})
+	s, err := runBackup(t, srcDir, dstDir, func(o *Options) { o.Checksum = true })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := runVerify(t, dstDir, 0)
+	if len(v.Results) != 1 || v.Failed() {
+		t.Fatalf("results: %v", v.Results)
+	}
+	if r := v.Results[0]; r.BackupID != s.ID || r.Checked != 4 || r.State != 1 {
+		t.Errorf("result: %+v", r)
+	}
+
+	if err := os.Remove(filepath.Join(s.DstDir, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.DstDir, "rewritten.txt"), []byte("REWRITTEN"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filepath.Join(s.DstDir, "truncated.txt"), 3); err != nil {
+		t.Fatal(err)
+	}
+	v = runVerify(t, dstDir, s.ID)
+	if len(v.Results) != 1 || !v.Failed() {
+		t.Fatalf("results: %v", v.Results)
+	}
+	if r := v.Results[0]; r.Checked != 4 || r.Missing != 1 || r.Corrupted != 2 || r.State >= 0 || r.Message == "" {
+		t.Errorf("result: %+v", r)
+	}
+
+	v = NewVerify(dstDir, false)
+	if err := v.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if err := v.Verify(s.ID + 1); err == nil {
+		t.Error("verified a backup which does not exist")
+	}
+	var count int
+	if err := v.db.QueryRow("select count(*) from bak_verify where backup_id = ? and state < 0", s.ID).Scan(&count); err != nil || count != 1 {
+		t.Errorf("%d failed results recorded: %v", count, err)
+	}
+}
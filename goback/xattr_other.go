@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package goback
+
+import "errors"
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are not supported")
+}
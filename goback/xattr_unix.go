@@ -0,0 +1,52 @@
+//go:build linux || darwin || freebsd || netbsd
+// +build linux darwin freebsd netbsd
+
+package goback
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file without following symlinks
+func readXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size < 1 {
+		return nil, ignoreUnsupported(err)
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, ignoreUnsupported(err)
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) < 1 {
+			continue
+		}
+		n, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, n)
+		n, err = unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = value[:n]
+	}
+	return xattrs, nil
+}
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+func ignoreUnsupported(err error) error {
+	if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}